@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	minPasswordLength = 8
+	// maxLoginFailures wrong passwords in a row get a client hung up on, and
+	// its address made to wait before it can try again
+	maxLoginFailures = 5
+	usersFile        = "users.json"
+	// loginBackoff is the first wait once an address has had too many
+	// wrong passwords, it doubles with every one after that up to
+	// maxLoginBackoff
+	loginBackoff    = time.Minute
+	maxLoginBackoff = time.Hour
+)
+
+// hashIterations is how many PBKDF2 rounds a new password gets, each
+// account keeps the count it was hashed with
+var hashIterations = 600000
+
+var (
+	errAlreadyRegistered = errors.New("That name is already registered")
+	errShortPassword     = errors.New("Passwords need at least 8 characters")
+	errWrongPassword     = errors.New("Wrong password")
+	errTooManyFailures   = errors.New("too many wrong passwords")
+)
+
+// loginThrottle counts wrong passwords per name and address and per
+// address, so hanging up and reconnecting doesn't buy anyone more guesses
+type loginThrottle struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+var logins = &loginThrottle{failures: make(map[string]*loginFailures)}
+
+// wait returns how long keys have to wait before the next password is
+// checked, the longest wait of any of them
+func (t *loginThrottle) wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var longest time.Duration
+	for _, key := range keys {
+		if f, ok := t.failures[key]; ok {
+			longest = max(longest, time.Until(f.last.Add(f.backoff())))
+		}
+	}
+	return longest
+}
+
+// failed counts a wrong password for keys and forgets the ones that have
+// waited out their backoff and then some
+func (t *loginThrottle) failed(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for key, f := range t.failures {
+		if now.Sub(f.last) > f.backoff()+maxLoginBackoff {
+			delete(t.failures, key)
+		}
+	}
+	for _, key := range keys {
+		f, ok := t.failures[key]
+		if !ok {
+			f = &loginFailures{}
+			t.failures[key] = f
+		}
+		f.count++
+		f.last = now
+	}
+}
+
+// succeeded clears the wrong passwords counted for keys
+func (t *loginThrottle) succeeded(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.failures, key)
+	}
+}
+
+func (f *loginFailures) backoff() time.Duration {
+	if f.count < maxLoginFailures {
+		return 0
+	}
+	backoff := loginBackoff
+	for i := maxLoginFailures; i < f.count && backoff < maxLoginBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxLoginBackoff)
+}
+
+// throttleKeys are what the wrong passwords c gives for name count against:
+// the name from c's address first, then the address alone. Guesses from
+// elsewhere never hold up the name's owner.
+func throttleKeys(c *client, name string) []string {
+	addr := c.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return []string{"login:" + nameKey(name) + "@" + addr, "addr:" + addr}
+}
+
+// account is a registered name and what its password hashes to
+type account struct {
+	Name       string    `json:"name"`
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+func (a *account) matches(password string) bool {
+	hash := pbkdf2.Key([]byte(password), a.Salt, a.Iterations, len(a.Hash), sha256.New)
+	return subtle.ConstantTimeCompare(hash, a.Hash) == 1
+}
+
+// userStore keeps the accounts in a JSON file, keyed like the sessions are
+// by nameKey so nobody can register a look-alike of a registered name
+type userStore struct {
+	path     string
+	mu       sync.Mutex
+	accounts map[string]*account
+}
+
+var users = &userStore{accounts: make(map[string]*account)}
+
+func newUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, accounts: make(map[string]*account)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		s.accounts[nameKey(a.Name)] = a
+	}
+	return s, nil
+}
+
+// registered returns the name an account was registered under, if name
+// (or something that looks like it) is one
+func (s *userStore) registered(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[nameKey(name)]
+	if !ok {
+		return "", false
+	}
+	return a.Name, true
+}
+
+func (s *userStore) register(name, password string) error {
+	if len(password) < minPasswordLength {
+		return errShortPassword
+	}
+	// hashing is the expensive part, so a taken name is turned down first.
+	// It's checked again below in case someone else got there meanwhile.
+	if _, taken := s.registered(name); taken {
+		return errAlreadyRegistered
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	a := &account{
+		Name:       name,
+		Salt:       salt,
+		Hash:       pbkdf2.Key([]byte(password), salt, hashIterations, 32, sha256.New),
+		Iterations: hashIterations,
+		Created:    time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nameKey(name)
+	if _, taken := s.accounts[key]; taken {
+		return errAlreadyRegistered
+	}
+	s.accounts[key] = a
+	if err := s.save(); err != nil {
+		delete(s.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// verify checks password against the account of name
+func (s *userStore) verify(name, password string) bool {
+	s.mu.Lock()
+	a, ok := s.accounts[nameKey(name)]
+	s.mu.Unlock()
+	return ok && a.matches(password)
+}
+
+// save writes every account to a temporary file first and moves it over
+// the old one, so a crash never leaves half a user file
+func (s *userStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]*account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// openAccounts loads the user store from the data dir
+func openAccounts() {
+	store, err := newUserStore(filepath.Join(config().DataDir, usersFile))
+	errorCheck("Error opening the user store:", err)
+	users = store
+}
+
+// askPassword asks c for the password of the registered name
+func askPassword(c *client, name string) error {
+	c.send("[PASSWORD FOR " + name + "]: ")
+	password, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return checkPassword(c, name, strings.TrimRight(password, "\r\n"))
+}
+
+// checkPassword verifies a password c gave for name, hanging up on c after
+// too many wrong ones. An address that keeps getting it wrong has to wait
+// longer and longer before its passwords are checked at all.
+func checkPassword(c *client, name, password string) error {
+	keys := throttleKeys(c, name)
+	if wait := logins.wait(keys...); wait > 0 {
+		warnf("Not checking a password for %s from %s for another %s", name, c.conn.RemoteAddr(), wait.Round(time.Second))
+		return fmt.Errorf("Too many wrong passwords, try again in %s", wait.Round(time.Second))
+	}
+	if users.verify(name, password) {
+		// the address keeps its own count, or logging in to an account of
+		// one's own would wipe out the guesses made at others
+		logins.succeeded(keys[0])
+		c.loginSucceeded(name)
+		return nil
+	}
+	logins.failed(keys...)
+	if c.loginFailed() >= maxLoginFailures {
+		warnf("Hanging up on client %d after %d wrong passwords", c.id, maxLoginFailures)
+		c.send(Red + "Too many wrong passwords, goodbye\n" + Reset)
+		c.kick()
+		return errTooManyFailures
+	}
+	return errWrongPassword
+}
+
+func registerAccountCommand(c *client, args []string) cmdResult {
+	if c.hasRegistered() {
+		c.send(Red + "You've already registered a name, one per session\n" + Reset)
+		return resultContinue
+	}
+	name := c.Name()
+	if err := users.register(name, args[0]); err != nil {
+		c.send(Red + err.Error() + "\n" + Reset)
+		return resultContinue
+	}
+	c.registeredAs(name)
+	infof("%s registered their name", name)
+	c.send(Green + name + " is registered, you'll need your password to use it from now on\n" + Reset)
+	return resultContinue
+}
+
+func loginCommand(c *client, args []string) cmdResult {
+	name, password := args[0], args[1]
+	registered, ok := users.registered(name)
+	if !ok {
+		c.send(Red + name + " isn't registered, :register: it first\n" + Reset)
+		return resultContinue
+	}
+	if err := checkPassword(c, registered, password); err != nil {
+		if err != errTooManyFailures {
+			c.send(Red + err.Error() + "\n" + Reset)
+		}
+		return resultContinue
+	}
+	oldName := c.Name()
+	if oldName != registered {
+		if err := sessions.rename(c, registered); err != nil {
+			c.send(Red + err.Error() + "\n" + Reset)
+			return resultContinue
+		}
+		renameClient(c, oldName, registered)
+	}
+	c.send(Green + "You're logged in as " + registered + "\n" + Reset)
+	return resultContinue
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStore(t *testing.T) {
+	defer func(n int) { hashIterations = n }(hashIterations)
+	hashIterations = 1000
+	path := filepath.Join(t.TempDir(), usersFile)
+	s, err := newUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.register("alice", "short"); err != errShortPassword {
+		t.Errorf("short password: %v", err)
+	}
+	if err := s.register("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	// a taken name is turned down before the password is hashed, which
+	// would take ages at this many rounds
+	hashIterations = 1 << 40
+	if err := s.register("ALICE", "another one"); err != errAlreadyRegistered {
+		t.Errorf("registering a look-alike: %v", err)
+	}
+	hashIterations = 1000
+
+	s, err = newUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := s.registered("Alice"); !ok || name != "alice" {
+		t.Errorf("registered(Alice) = %q, %v", name, ok)
+	}
+	if !s.verify("alice", "correct horse") || s.verify("alice", "wrong horse") || s.verify("bob", "correct horse") {
+		t.Error("verify gave the wrong answer")
+	}
+}
+
+func TestRegisterOncePerSession(t *testing.T) {
+	defer func(n int, old *userStore) { hashIterations, users = n, old }(hashIterations, users)
+	hashIterations = 1000
+	users = &userStore{accounts: make(map[string]*account)}
+	c := &client{name: "alice", out: make(chan string, 10), done: make(chan struct{})}
+
+	registerAccountCommand(c, []string{"correct horse"})
+	if !c.loggedIn() {
+		t.Fatal("registering didn't log the client in")
+	}
+	c.name = "bob"
+	registerAccountCommand(c, []string{"correct horse"})
+	if _, ok := users.registered("bob"); ok {
+		t.Error("a session registered a second name")
+	}
+	if got := <-c.out + <-c.out; !strings.Contains(got, "one per session") {
+		t.Errorf("client was told %q", got)
+	}
+}
+
+// remoteConn is a connection that seems to come from addr
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestLoginThrottle(t *testing.T) {
+	defer func(n int, old *userStore, oldLogins *loginThrottle) {
+		hashIterations, users, logins = n, old, oldLogins
+	}(hashIterations, users, logins)
+	hashIterations = 1000
+	users = &userStore{accounts: make(map[string]*account)}
+	logins = &loginThrottle{failures: make(map[string]*loginFailures)}
+	if err := users.register("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	newClient := func(ip string) *client {
+		server, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		conn := remoteConn{server, &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+		return &client{conn: conn, out: make(chan string, 10), done: make(chan struct{})}
+	}
+
+	// reconnecting after every guess doesn't get around the limit
+	for range maxLoginFailures {
+		if err := checkPassword(newClient("203.0.113.7"), "alice", "wrong horse"); err != errWrongPassword {
+			t.Fatalf("wrong password: %v", err)
+		}
+	}
+	guesser := newClient("203.0.113.7")
+	if err := checkPassword(guesser, "alice", "correct horse"); err == nil || guesser.loggedIn() {
+		t.Fatal("password was checked while the address was throttled")
+	}
+	if err := checkPassword(guesser, "bob", "anything"); err == nil || err == errWrongPassword {
+		t.Errorf("throttled address got to guess at another name: %v", err)
+	}
+	if wait := logins.wait(throttleKeys(guesser, "alice")...); wait <= 0 || wait > loginBackoff {
+		t.Errorf("the address has to wait %s", wait)
+	}
+	logins.failed("addr:203.0.113.7")
+	if wait := logins.wait("addr:203.0.113.7"); wait <= loginBackoff {
+		t.Errorf("backoff didn't grow: %s", wait)
+	}
+
+	// strangers guessing wrong don't lock the owner out of the name
+	owner := newClient("198.51.100.2")
+	if err := checkPassword(owner, "alice", "correct horse"); err != nil {
+		t.Fatalf("owner was refused: %v", err)
+	}
+
+	for _, key := range throttleKeys(guesser, "alice") {
+		logins.failures[key].last = time.Now().Add(-maxLoginBackoff)
+	}
+	if err := checkPassword(guesser, "alice", "correct horse"); err != nil {
+		t.Fatalf("right password after the wait: %v", err)
+	}
+	keys := throttleKeys(guesser, "alice")
+	if _, ok := logins.failures[keys[0]]; ok {
+		t.Error("logging in didn't clear the name's count")
+	}
+	if _, ok := logins.failures[keys[1]]; !ok {
+		t.Error("logging in cleared the address's count")
+	}
+}
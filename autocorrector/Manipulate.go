@@ -1,157 +1,199 @@
 package autocorrector
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
 
+// Manipulate applies the markers in text, like "ff (hex)" or
+// "three words (up, 3)". If a marker can't be applied the text is returned
+// as it was, use ApplyMarkers to find out why.
 func Manipulate(text string) string {
-	new := ""
-	vowels := []rune{'a', 'e', 'i', 'o', 'u', 'h', 'A', 'E', 'I', 'O', 'U', 'H'}
-	concatenated := ""
-	separated := strings.Split(text, " ") // Split the input text into words
-	toRemove := []int{}                   // Initialize a slice to keep track of indices to remove
+	out, err := ApplyMarkers(text)
+	if err != nil {
+		return strings.TrimSpace(text)
+	}
+	return out
+}
 
-	for i := 0; i < len(separated); i++ {
+type tokenKind int
 
-		// Handle "a" or "A" followed by a word starting with a vowel
-		if separated[i] == "a" || separated[i] == "A" {
-			if i+1 != len(separated) {
-				next := separated[i+1]
-				for _, c := range vowels {
-					if rune(next[0]) == c {
-						separated[i] += "n" // Replace "a" with "an" or "A" with "An"
-					}
-				}
-			}
-		}
+const (
+	wordToken tokenKind = iota
+	spaceToken
+	markerToken
+)
 
-		// Handle hexadecimal to decimal conversion "(hex)" command
-		if separated[i] == "(hex)" {
-			if i > 0 {
-				new1, _ := strconv.ParseInt(separated[i-1], 16, 64) // Parse previous word as hexadecimal
-				separated[i-1] = strconv.Itoa(int(new1))            // Convert decimal to string
-				toRemove = append(toRemove, i)                      // Mark "(hex)" for removal
-			}
-		}
+// markerTok is a piece of the text: a word, the whitespace between words, or
+// a marker such as "(cap, 2)" that applies to the count words before it
+type markerTok struct {
+	kind   tokenKind
+	text   string
+	marker string
+	count  int
+}
 
-		// Handle binary to decimal conversion "(bin)" command
-		if separated[i] == "(bin)" {
-			if i > 0 {
-				new1, _ := strconv.ParseInt(separated[i-1], 2, 64) // Parse previous word as binary
-				separated[i-1] = strconv.Itoa(int(new1))           // Convert decimal to string
-				toRemove = append(toRemove, i)                     // Mark "(bin)" for removal
-			}
-		}
+// markers are the names that can go between brackets
+var markers = map[string]bool{"hex": true, "bin": true, "up": true, "low": true, "cap": true}
 
-		// Handle capitalization "(cap)" command
-		if separated[i] == "(cap)" {
-			if i > 0 {
-				new = Capitalize(separated[i-1]) // Capitalize the previous word
-				separated[i-1] = new
-				toRemove = append(toRemove, i) // Mark "(cap)" for removal
-			}
-		}
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t'
+}
 
-		// Handle uppercase transformation "(up)" command
-		if separated[i] == "(up)" {
-			if i > 0 {
-				new = ToUpper(separated[i-1]) // Convert the previous word to uppercase
-				separated[i-1] = new
-				toRemove = append(toRemove, i) // Mark "(up)" for removal
+// lexMarkers splits text into words, spaces and markers. A marker may be
+// stuck to the word before it, as in "word(up)".
+func lexMarkers(text string) ([]markerTok, error) {
+	var tokens []markerTok
+	for i := 0; i < len(text); {
+		start := i
+		switch {
+		case isSpace(text[i]):
+			for i < len(text) && isSpace(text[i]) {
+				i++
 			}
-		}
-
-		// Handle lowercase transformation "(low)" command
-		if separated[i] == "(low)" {
-			if i > 0 {
-				new = ToLower(separated[i-1]) // Convert the previous word to lowercase
-				separated[i-1] = new
-				toRemove = append(toRemove, i) // Mark "(low)" for removal
+			tokens = append(tokens, markerTok{kind: spaceToken, text: text[start:i]})
+			continue
+		case text[i] == '(':
+			tok, n, err := lexMarker(text[i:])
+			if err != nil {
+				return nil, err
 			}
-		}
-
-		// Handle capitalization for previous 'n' words "(cap," command
-		if separated[i] == "(cap," {
-			if i > 0 {
-				num := "" // Initialize num to collect digits
-				for _, v := range separated[i+1] {
-					if v == ')' {
-						break // Stop adding when closing parenthesis is found
-					} else {
-						num += string(v) // Collect digits for number
-					}
-				}
-				n, _ := strconv.Atoi(num) // Convert collected number to integer
-				for j := 1; j <= n && i-j >= 0; j++ {
-					new = Capitalize(separated[i-j]) // Apply Capitalize to each of the previous 'n' words
-					separated[i-j] = new
-				}
-				toRemove = append(toRemove, i, i+1) // Mark both "(cap," and the number for removal
+			if n > 0 {
+				tokens = append(tokens, tok)
+				i += n
+				continue
 			}
 		}
-
-		// Handle uppercase transformation for previous 'n' words "(up," command
-		if separated[i] == "(up," {
-			if i > 0 {
-				num := "" // Initialize num to collect digits
-				for _, v := range separated[i+1] {
-					if v == ')' {
-						break // Stop adding when closing parenthesis is found
-					} else {
-						num += string(v) // Collect digits for number
-					}
-				}
-				n, _ := strconv.Atoi(num) // Convert collected number to integer
-				for j := 1; j <= n && i-j >= 0; j++ {
-					new = ToUpper(separated[i-j]) // Apply ToUpper to each of the previous 'n' words
-					separated[i-j] = new
+		// a word runs up to the next space or marker
+		for i++; i < len(text) && !isSpace(text[i]); i++ {
+			if text[i] == '(' {
+				if _, n, err := lexMarker(text[i:]); n > 0 || err != nil {
+					break
 				}
-				toRemove = append(toRemove, i, i+1) // Mark both "(up," and the number for removal
 			}
 		}
+		tokens = append(tokens, markerTok{kind: wordToken, text: text[start:i]})
+	}
+	return tokens, nil
+}
 
-		// Handle lowercase transformation for previous 'n' words "(low," command
-		if separated[i] == "(low," {
-			if i > 0 {
-				num := "" // Initialize num to collect digits
-				for _, v := range separated[i+1] {
-					if v == ')' {
-						break // Stop adding when closing parenthesis is found
-					} else {
-						num += string(v) // Collect digits for number
-					}
-				}
-				n, _ := strconv.Atoi(num) // Convert collected number to integer
-				for j := 1; j <= n && i-j >= 0; j++ {
-					new = ToLower(separated[i-j]) // Apply ToLower to each of the previous 'n' words
-					separated[i-j] = new
-				}
-				toRemove = append(toRemove, i, i+1) // Mark both "(low," and the number for removal
-			}
-		}
+// lexMarker reads the marker s starts with and how long it is. n is 0 if s
+// doesn't start with a marker, a bracket followed by a marker name that
+// doesn't end properly is an error.
+func lexMarker(s string) (tok markerTok, n int, err error) {
+	i := 1
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z') {
+		i++
+	}
+	name := strings.ToLower(s[1:i])
+	if !markers[name] || i == len(s) || (s[i] != ')' && s[i] != ',') {
+		return markerTok{}, 0, nil
+	}
+	tok = markerTok{kind: markerToken, text: s[:i], marker: name, count: 1}
+	if s[i] == ')' {
+		tok.text = s[:i+1]
+		return tok, i + 1, nil
+	}
 
+	i++
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	digits := i
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
 	}
+	number := s[digits:i]
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	if number == "" || i == len(s) || s[i] != ')' {
+		return markerTok{}, 0, fmt.Errorf("(%s, needs a number and a closing bracket, like (%s, 2)", name, name)
+	}
+	tok.count, err = strconv.Atoi(number)
+	if err != nil || tok.count < 1 {
+		return markerTok{}, 0, fmt.Errorf("(%s, %s) needs a number from 1 up", name, number)
+	}
+	tok.text = s[:i+1]
+	return tok, i + 1, nil
+}
 
-	// Create a new slice excluding the marked indices for removal
-	sepShorter := []string{}
-	for i, s := range separated {
-		found := false
-		for _, num := range toRemove {
-			if i == num {
-				found = true
+// ApplyMarkers applies every marker in text to the words before it and
+// removes the markers. It reports the first marker that can't be applied,
+// like a (hex) after something that isn't a hexadecimal number.
+func ApplyMarkers(text string) (string, error) {
+	tokens, err := lexMarkers(text)
+	if err != nil {
+		return "", err
+	}
+	var out []markerTok
+	for _, tok := range tokens {
+		if tok.kind != markerToken {
+			out = append(out, tok)
+			continue
+		}
+		for len(out) > 0 && out[len(out)-1].kind == spaceToken {
+			out = out[:len(out)-1]
+		}
+		applied := 0
+		for i := len(out) - 1; i >= 0 && applied < tok.count; i-- {
+			if out[i].kind != wordToken {
+				continue
+			}
+			word, err := applyMarker(tok.marker, out[i].text)
+			if err != nil {
+				return "", err
 			}
+			out[i].text = word
+			applied++
 		}
-		if !found {
-			sepShorter = append(sepShorter, s)
+		if applied == 0 {
+			return "", fmt.Errorf("%s has no word before it", tok.text)
 		}
 	}
+	fixArticles(out)
 
-	separated = sepShorter
+	var b strings.Builder
+	for _, tok := range out {
+		b.WriteString(tok.text)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
 
-	// Join the remaining words back into a single string
-	concatenated = strings.Join(sepShorter, " ")
-	concatenated = strings.TrimSpace(concatenated) // Remove any leading or trailing spaces
+func applyMarker(marker, word string) (string, error) {
+	switch marker {
+	case "up":
+		return ToUpper(word), nil
+	case "low":
+		return ToLower(word), nil
+	case "cap":
+		return Capitalize(word), nil
+	}
+	base, baseName := 16, "hexadecimal"
+	if marker == "bin" {
+		base, baseName = 2, "binary"
+	}
+	// punctuation after the number stays where it is
+	number := strings.TrimRight(word, ".,!?:;")
+	n, err := strconv.ParseInt(number, base, 64)
+	if err != nil {
+		return "", fmt.Errorf("%q isn't a %s number", number, baseName)
+	}
+	return strconv.FormatInt(n, 10) + word[len(number):], nil
+}
 
-	return concatenated
+// fixArticles turns "a" into "an" before a word starting with a vowel or h
+func fixArticles(tokens []markerTok) {
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].text != "a" && tokens[i].text != "A" {
+			continue
+		}
+		if tokens[i+1].kind != spaceToken || tokens[i+2].kind != wordToken {
+			continue
+		}
+		if strings.ContainsRune("aeiouhAEIOUH", rune(tokens[i+2].text[0])) {
+			tokens[i].text += "n"
+		}
+	}
 }
@@ -0,0 +1,68 @@
+package autocorrector
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestApplyMarkers(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"1E (hex) files were added", "30 files were added"},
+		{"It has been 10 (bin) years", "It has been 2 years"},
+		{"Ready, set, go (up) !", "Ready, set, GO !"},
+		{"word(up), and more", "WORD, and more"},
+		{"I should stop SHOUTING (low)", "I should stop shouting"},
+		{"welcome to the brooklyn bridge (cap, 2)", "welcome to the Brooklyn Bridge"},
+		{"ff 10 (hex, 2) and 101 11 (bin,2)", "255 16 and 5 3"},
+		{"ff, (hex)", "255,"},
+		{"This is so exciting (up, 2)", "This is SO EXCITING"},
+		{"a apple and a (hello) a", "an apple and a (hello) a"},
+		{"(upper) case (uP)", "(upper) CASE"},
+		{"only two (up, 5)", "ONLY TWO"},
+	}
+	for _, tt := range tests {
+		got, err := ApplyMarkers(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ApplyMarkers(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestApplyMarkersErrors(t *testing.T) {
+	for _, in := range []string{
+		"word (cap,",
+		"word (cap, x)",
+		"word (up, 0)",
+		"word (low, 99999999999999999999)",
+		"zz (hex)",
+		"12 (bin)",
+		"(up) first",
+		"   (cap)",
+	} {
+		if out, err := ApplyMarkers(in); err == nil {
+			t.Errorf("ApplyMarkers(%q) = %q, want an error", in, out)
+		}
+		if got := Manipulate(in); got != strings.TrimSpace(in) {
+			t.Errorf("Manipulate(%q) = %q, want it unchanged", in, got)
+		}
+	}
+}
+
+func FuzzApplyMarkers(f *testing.F) {
+	for _, seed := range []string{
+		"1E (hex) files", "word (cap,", "word(up),", "a (bin, 3) b", "((up)", "(cap, 2 )", "a  a\tapple", "ö (up)",
+	} {
+		f.Add(seed)
+	}
+	// the only promises are that nothing panics and text stays text
+	f.Fuzz(func(t *testing.T, in string) {
+		out, err := ApplyMarkers(in)
+		if err != nil {
+			return
+		}
+		if utf8.ValidString(in) && !utf8.ValidString(out) {
+			t.Errorf("ApplyMarkers(%q) = %q isn't valid UTF-8", in, out)
+		}
+	})
+}
@@ -2,44 +2,28 @@ package autocorrector
 
 import (
 	"encoding/json"
-	"log"
 	"os"
-	"strings"
 )
 
-var badWords[]string
-
-func Input(text string) string{
-	umarshalBadWords()
+func Input(text string) string {
 	text = Manipulate(text) // Perform some manipulation on the text
-	text = Punctuate(text) // Add punctuation to the text
-	text = FixQuotes(text) // Fix quotes in the text
-	text = isThisaBadWord(text)
+	text = Punctuate(text)  // Add punctuation to the text
+	text = FixQuotes(text)  // Fix quotes in the text
+	text = MaskBadWords(text)
 	return text
 }
 
-func umarshalBadWords() {
-	data, err := os.ReadFile("autocorrector/words.json")
+// LoadBadWords compiles the JSON list of bad words at path. The old list
+// is kept if the file can't be read, so it's safe to call again on a reload.
+func LoadBadWords(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Println("error reading the json file", err)
+		return err
 	}
-
-	err = json.Unmarshal(data, &badWords)
-	if err != nil {
-		log.Println("error unmarshaling the json file", err)
+	var words []string
+	if err := json.Unmarshal(data, &words); err != nil {
+		return err
 	}
+	badWords.Store(Compile(words))
+	return nil
 }
-
-func isThisaBadWord(text string) string {
-	text = strings.ToLower(text)
-	words := strings.Split(text, " ")
-	for i := 0; i < len(words); i++ {
-		for j := 0; j < len(badWords); j++ {
-			if words[i] == badWords[j] {
-				words[i] = string(words[i][0]) + strings.Repeat("*", len(words[i])-1)
-			}
-		}
-	}
-	text = strings.Join(words, " ")
-	return text
-}
\ No newline at end of file
@@ -0,0 +1,212 @@
+package autocorrector
+
+import (
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// leet maps the look-alike characters people swap into bad words back to
+// the letters they stand for
+var leet = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '+': 't',
+}
+
+// isWordChar says whether r can be part of a word, a leet symbol included
+func isWordChar(r rune) bool {
+	_, isLeet := leet[r]
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || isLeet
+}
+
+// isFiller says whether r is skipped inside a word, as in "f.u.c.k"
+func isFiller(r rune) bool {
+	return r == '.' || r == '-' || r == '_' || r == '*'
+}
+
+// normalize lowercases a word, undoes leetspeak and drops fillers. Only
+// words with a letter in them are leetspeak, so numbers like "455" and
+// "7175" are left as they are.
+func normalize(word string) string {
+	decode := strings.IndexFunc(word, unicode.IsLetter) >= 0
+	var b strings.Builder
+	for _, r := range word {
+		if isFiller(r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if plain, ok := leet[r]; ok && decode {
+			r = plain
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// token is a word of the text, Start and End are byte offsets of the word
+// without the punctuation around it
+type token struct {
+	start, end int
+	norm       string
+}
+
+func tokenize(text string) []token {
+	var tokens []token
+	for _, field := range fieldSpans(text) {
+		start, end := field[0], field[1]
+		for start < end {
+			r, size := utf8.DecodeRuneInString(text[start:])
+			if isWordChar(r) {
+				break
+			}
+			start += size
+		}
+		for end > start {
+			r, size := utf8.DecodeLastRuneInString(text[start:end])
+			if isWordChar(r) && r != '!' && r != '+' {
+				break
+			}
+			end -= size
+		}
+		if norm := normalize(text[start:end]); norm != "" {
+			tokens = append(tokens, token{start, end, norm})
+		}
+	}
+	return tokens
+}
+
+// fieldSpans returns where the whitespace separated fields of text start
+// and end
+func fieldSpans(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+type trieNode struct {
+	next map[string]*trieNode
+	// word is the list entry that ends here, "" if none does
+	word string
+}
+
+// Matcher finds bad words and phrases in text. It's compiled once from the
+// word list and safe to use from many goroutines.
+type Matcher struct {
+	root *trieNode
+}
+
+// Match is a bad word or phrase found in a text, Start and End are byte
+// offsets into the text and Word the list entry it matched
+type Match struct {
+	Start, End int
+	Word       string
+}
+
+// Compile builds a Matcher from a list of words and phrases
+func Compile(words []string) *Matcher {
+	m := &Matcher{root: &trieNode{}}
+	for _, word := range words {
+		tokens := tokenize(word)
+		if len(tokens) == 0 {
+			continue
+		}
+		node := m.root
+		for _, t := range tokens {
+			child, ok := node.next[t.norm]
+			if !ok {
+				if node.next == nil {
+					node.next = make(map[string]*trieNode)
+				}
+				child = &trieNode{}
+				node.next[t.norm] = child
+			}
+			node = child
+		}
+		node.word = word
+	}
+	return m
+}
+
+// Find returns the bad words and phrases in text, the longest one wins
+// where they overlap
+func (m *Matcher) Find(text string) []Match {
+	tokens := tokenize(text)
+	var matches []Match
+	for i := 0; i < len(tokens); {
+		node, last, word := m.root, -1, ""
+		for j := i; j < len(tokens); j++ {
+			node = node.next[tokens[j].norm]
+			if node == nil {
+				break
+			}
+			if node.word != "" {
+				last, word = j, node.word
+			}
+		}
+		if last < 0 {
+			i++
+			continue
+		}
+		matches = append(matches, Match{tokens[i].start, tokens[last].end, word})
+		i = last + 1
+	}
+	return matches
+}
+
+// Mask stars out every bad word or phrase in text but its first letter,
+// leaving the case of what's kept and everything around it alone
+func (m *Matcher) Mask(text string) string {
+	matches := m.Find(text)
+	if len(matches) == 0 {
+		return text
+	}
+	var b strings.Builder
+	prev := 0
+	for _, match := range matches {
+		b.WriteString(text[prev:match.Start])
+		for i, r := range text[match.Start:match.End] {
+			if i > 0 && (isWordChar(r) || isFiller(r)) {
+				b.WriteByte('*')
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		prev = match.End
+	}
+	b.WriteString(text[prev:])
+	return b.String()
+}
+
+// badWords is the matcher LoadBadWords last compiled
+var badWords atomic.Pointer[Matcher]
+
+// FindBadWords returns the bad words in text, nothing until the word list
+// has been loaded
+func FindBadWords(text string) []Match {
+	if m := badWords.Load(); m != nil {
+		return m.Find(text)
+	}
+	return nil
+}
+
+// MaskBadWords stars out the bad words in text, see Matcher.Mask
+func MaskBadWords(text string) string {
+	if m := badWords.Load(); m != nil {
+		return m.Mask(text)
+	}
+	return text
+}
@@ -0,0 +1,56 @@
+package autocorrector
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	m := Compile([]string{"shit", "alabama hot pocket", "a_s_s", "f.u.c.k", "hell"})
+	tests := []struct{ in, want string }{
+		{"Oh SHIT, really", "Oh S***, really"},
+		{"oh 5h1t!", "oh 5***!"},
+		{"an Alabama  hot pocket?", "an A******  *** ******?"},
+		{"what the f.u.c.k", "what the f******"},
+		{"you a$$", "you a**"},
+		{"he'll go to hell.", "he'll go to h***."},
+		{"alabama hot dog", "alabama hot dog"},
+		{"shitake", "shitake"},
+		{"I owe you 455 dollars", "I owe you 455 dollars"},
+		{"call 7175", "call 7175"},
+	}
+	for _, tt := range tests {
+		if got := m.Mask(tt.in); got != tt.want {
+			t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if found := m.Find("ALABAMA HOT POCKET"); len(found) != 1 || found[0].Word != "alabama hot pocket" {
+		t.Errorf("Find = %+v", found)
+	}
+}
+
+func TestMaskNumbers(t *testing.T) {
+	data, err := os.ReadFile("words.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var words []string
+	if err := json.Unmarshal(data, &words); err != nil {
+		t.Fatal(err)
+	}
+	m := Compile(words)
+	tests := []struct{ in, want string }{
+		{"I owe you 455 dollars", "I owe you 455 dollars"},
+		{"call 7175", "call 7175"},
+		{"room 404, 3.50 each", "room 404, 3.50 each"},
+		// it has a letter in it, so it's still read as leetspeak
+		{"$3x", "$**"},
+		{"you a55", "you a**"},
+	}
+	for _, tt := range tests {
+		if got := m.Mask(tt.in); got != tt.want {
+			t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
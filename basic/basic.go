@@ -3,13 +3,17 @@ package basic
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/atouba/piscine"
 )
 
+// BannersDir is where the banner fonts are read from
+var BannersDir = "banners"
+
 // printBasic generates ascii art for the function Basic()
 func printBasic(inLineStr, banner string) string {
-	asciiArtChars, err := os.ReadFile("./banners/" + banner + ".txt")
+	asciiArtChars, err := os.ReadFile(filepath.Join(BannersDir, banner+".txt"))
 	if err != nil {
 		fmt.Println("Error reading banner file")
 		return ""
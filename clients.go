@@ -1,75 +1,567 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// pendingConversation is mapping the group name to the conversation string
+const (
+	dropOldest = "drop-oldest"
+	disconnect = "disconnect"
+)
+
+// pendingConversation is mapping the group name to the conversation string.
+// name, currActiveGroup, groups and pendingConv are read by room goroutines
+// as well as the client's own, so they're guarded by mu.
+// Everything written to the client goes through out, which its writeLoop
+// drains, so a stalled connection only ever holds up itself.
 type client struct {
+	id              int
+	conn            net.Conn
+	reader          *bufio.Reader
+	out             chan string
+	done            chan struct{}
+	closeOnce       sync.Once
+	mu              sync.Mutex
 	name            string
 	currActiveGroup string
-	conn            net.Conn
+	groups          []string
 	pendingConv     map[string]string
+	// historyFrom is the ID of the oldest record shown per group, where
+	// :more: carries on from, and pageSize how many it shows at a time
+	historyFrom map[string]int64
+	pageSize    int
+	// lastActive is when the client last sent a line
+	lastActive time.Time
+	// sent counts the messages of the current rate limit window, which
+	// started at windowStart
+	sent        int
+	windowStart time.Time
+	// strikes counts the warnings for bad language
+	strikes int
+	// account is the registered name the client has given the password of,
+	// failedLogins the wrong passwords since. registered says whether the
+	// session registered a name itself, it only gets to register one since
+	// every registration costs a full password hash.
+	account      string
+	failedLogins int
+	registered   bool
+	// sessionKey tells the session apart from every other one, from
+	// earlier runs of the server too, unlike id. A resumed session keeps it.
+	sessionKey string
+	// token is what the session can be resumed with, it's the session
+	// store's and guarded by its mu
+	token string
+	// sendMu guards where send puts messages, apart from mu since deliver
+	// sends with mu held. While the client is detached they're kept in
+	// missed, once another client resumed the session they go on to it.
+	sendMu    sync.Mutex
+	detached  bool
+	kicked    bool
+	missed    []string
+	resumedBy *client
 }
 
-type clients []client
+func (c *client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
 
-var clientsArr clients
+// touch marks the client as active now
+func (c *client) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastActive = time.Now()
+}
 
-func isClientInClientsArr(conn net.Conn) bool {
-	for _, c := range clientsArr {
-		if c.conn == conn {
-			return true
+// allow says whether the client may send another message under limit
+func (c *client) allow(limit rateLimit) bool {
+	if limit.Messages == 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.windowStart) >= time.Duration(limit.Per) {
+		c.windowStart, c.sent = now, 0
+	}
+	if c.sent >= limit.Messages {
+		return false
+	}
+	c.sent++
+	return true
+}
+
+func (c *client) loginSucceeded(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.account, c.failedLogins = name, 0
+}
+
+// registeredAs logs the client in to the account it just registered
+func (c *client) registeredAs(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.account, c.failedLogins, c.registered = name, 0, true
+}
+
+func (c *client) hasRegistered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registered
+}
+
+// loginFailed counts a wrong password and returns how many there have been
+func (c *client) loginFailed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failedLogins++
+	return c.failedLogins
+}
+
+// loggedIn says whether the client is using a name it gave the password of
+func (c *client) loggedIn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account != "" && nameKey(c.account) == nameKey(c.name)
+}
+
+// mayUse says whether the client may take name, which it may unless it's
+// registered to an account the client hasn't logged in to
+func (c *client) mayUse(name string) bool {
+	registered, ok := users.registered(name)
+	if !ok {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account == registered
+}
+
+// strike gives the client another strike and returns how many it has
+func (c *client) strike() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strikes++
+	return c.strikes
+}
+
+func (c *client) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastActive)
+}
+
+func (c *client) activeGroup() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currActiveGroup
+}
+
+// focus makes groupName the client's active group, adding it to its groups
+func (c *client) focus(groupName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currActiveGroup = groupName
+	for _, g := range c.groups {
+		if g == groupName {
+			return
 		}
 	}
-	return false
+	c.groups = append(c.groups, groupName)
 }
 
-func registerClient(name, currGroup string, conn net.Conn) int {
-	if isClientInClientsArr(conn) {
-		log.Println("Can't register client. It's already in.")
-		return getClientId(conn)
+// forget drops groupName from the client's groups, clearing the focus if
+// it was the active one
+func (c *client) forget(groupName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, g := range c.groups {
+		if g == groupName {
+			c.groups = append(c.groups[:i], c.groups[i+1:]...)
+			break
+		}
+	}
+	delete(c.pendingConv, groupName)
+	delete(c.historyFrom, groupName)
+	if c.currActiveGroup == groupName {
+		c.currActiveGroup = ""
 	}
-	clientsArr = append(clientsArr, client{
-		name:            name,
-		currActiveGroup: currGroup,
-		conn:            conn,
-		pendingConv:     make(map[string]string),
-	})
-	return len(clientsArr) - 1
 }
 
-func getClientById(clientId int) *client {
-	if clientId < len(clientsArr) {
-		return &clientsArr[clientId]
+// lastGroup returns the most recently joined group the client is still in
+func (c *client) lastGroup() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.groups) == 0 {
+		return ""
 	}
-	return nil
+	return c.groups[len(c.groups)-1]
 }
 
-func getClientByConn(conn net.Conn) *client {
-	for i, c := range clientsArr {
-		if c.conn == conn {
-			return &clientsArr[i]
+func (c *client) deliver(groupName, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if next := c.successor(); next != nil {
+		next.deliver(groupName, message)
+		return
+	}
+	if c.currActiveGroup != groupName {
+		c.pendingConv[groupName] += message
+		return
+	}
+	c.send(message)
+}
+
+// deliverDirect shows a direct message straight away if the client is
+// focused on fromGroup, where it was sent from, and otherwise keeps it in
+// pendingConv under the conversation. It reports whether it was kept.
+func (c *client) deliverDirect(conversation, fromGroup, message string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if next := c.successor(); next != nil {
+		return next.deliverDirect(conversation, fromGroup, message)
+	}
+	if c.currActiveGroup != fromGroup {
+		c.pendingConv[conversation] += message
+		return true
+	}
+	c.send(message)
+	return false
+}
+
+// send queues message for the client without ever blocking. When the queue
+// is full the -slow-client policy decides whether the oldest queued message
+// is dropped or the client is cut off.
+func (c *client) send(message string) {
+	c.sendMu.Lock()
+	if next := c.resumedBy; next != nil {
+		c.sendMu.Unlock()
+		next.send(message)
+		return
+	}
+	if c.detached {
+		c.missed = append(c.missed, message)
+		if len(c.missed) > config().QueueSize {
+			c.missed = c.missed[1:]
 		}
+		c.sendMu.Unlock()
+		return
 	}
-	return nil
+	c.sendMu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	for {
+		select {
+		case c.out <- message:
+			return
+		default:
+		}
+		if config().SlowClient == disconnect {
+			warnf("Disconnecting slow client %d", c.id)
+			c.conn.Close()
+			c.hangUp()
+			return
+		}
+		select {
+		case <-c.out:
+		default:
+		}
+	}
+}
+
+// hangUp stops the client's writer once it has flushed what's still queued
+// and closes the connection
+func (c *client) hangUp() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// kick hangs up on the client for good, its session can't be resumed
+func (c *client) kick() {
+	c.sendMu.Lock()
+	c.kicked = true
+	c.sendMu.Unlock()
+	c.hangUp()
 }
 
-func getClientId(conn net.Conn) int {
-	for i, c := range clientsArr {
-		if c.conn == conn {
-			return i
+// detach keeps the client's messages for when its session is resumed,
+// unless it was kicked. It reports whether it did.
+func (c *client) detach() bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.kicked {
+		return false
+	}
+	c.detached = true
+	return true
+}
+
+// expire stops keeping the messages of a detached client, it reports false
+// if the session isn't detached anymore because it was resumed
+func (c *client) expire() bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.detached {
+		return false
+	}
+	c.detached, c.missed = false, nil
+	return true
+}
+
+// successor returns the client that resumed this one's session, if any
+func (c *client) successor() *client {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.resumedBy
+}
+
+// handOver moves the session of the detached client c to next: its name,
+// groups, focus and unread messages, and the messages it missed. Whatever
+// is still sent to c from then on goes to next. It reports false if c isn't
+// detached.
+func (c *client) handOver(next *client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.detached {
+		return false
+	}
+	next.mu.Lock()
+	next.name, next.currActiveGroup, next.groups = c.name, c.currActiveGroup, c.groups
+	next.pendingConv, next.historyFrom, next.pageSize = c.pendingConv, c.historyFrom, c.pageSize
+	next.sent, next.windowStart, next.strikes = c.sent, c.windowStart, c.strikes
+	next.account, next.registered, next.sessionKey = c.account, c.registered, c.sessionKey
+	next.mu.Unlock()
+	for _, message := range c.missed {
+		next.send(message)
+	}
+	c.detached, c.missed, c.resumedBy = false, nil, next
+	return true
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case message := <-c.out:
+			if !c.write(message) {
+				return
+			}
+		case <-c.done:
+			for {
+				select {
+				case message := <-c.out:
+					if !c.write(message) {
+						return
+					}
+				default:
+					c.conn.Close()
+					return
+				}
+			}
 		}
 	}
-	return -1
 }
 
-func isDuplicateName(name string) bool {
-	for _, v := range clientsArr {
-		if v.name == name {
+func (c *client) write(message string) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(config().WriteTimeout)))
+	if _, err := c.conn.Write([]byte(message)); err != nil {
+		debugf("Error sending message to client %d: %v", c.id, err)
+		c.conn.Close()
+		c.hangUp()
+		return false
+	}
+	return true
+}
+
+// unread counts the lines waiting in pendingConv for groupName
+func (c *client) unread(groupName string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Count(c.pendingConv[groupName], "\n")
+}
+
+// isIn reports whether groupName is one of the client's groups
+func (c *client) isIn(groupName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups {
+		if g == groupName {
 			return true
 		}
 	}
 	return false
 }
+
+// takePending returns and clears what arrived in groupName while the
+// client was focused elsewhere
+func (c *client) takePending(groupName string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conv := c.pendingConv[groupName]
+	delete(c.pendingConv, groupName)
+	return conv
+}
+
+// sessionStore keeps every live client indexed by session id, connection
+// and name, and the detached ones by their resume token. Session ids are
+// handed out monotonically and never reused, so an id left behind somewhere
+// can't end up pointing at a different client.
+type sessionStore struct {
+	mu      sync.RWMutex
+	nextID  int
+	byID    map[int]*client
+	byConn  map[net.Conn]*client
+	byName  map[string]*client
+	byToken map[string]*client
+}
+
+var sessions = newSessionStore()
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		nextID:  1,
+		byID:    make(map[int]*client),
+		byConn:  make(map[net.Conn]*client),
+		byName:  make(map[string]*client),
+		byToken: make(map[string]*client),
+	}
+}
+
+// register creates a nameless session for conn and starts its writer. If
+// conn already has a session, that session is returned instead.
+func (s *sessionStore) register(conn net.Conn) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.byConn[conn]; ok {
+		return c
+	}
+	c := &client{
+		id:          s.nextID,
+		sessionKey:  strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.Itoa(s.nextID),
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		out:         make(chan string, config().QueueSize),
+		done:        make(chan struct{}),
+		pendingConv: make(map[string]string),
+		historyFrom: make(map[string]int64),
+		pageSize:    config().Replay,
+		lastActive:  time.Now(),
+	}
+	s.nextID++
+	s.byID[c.id] = c
+	s.byConn[conn] = c
+	go c.writeLoop()
+	return c
+}
+
+func (s *sessionStore) get(id int) *client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byID[id]
+}
+
+// all returns a snapshot of every live session
+func (s *sessionStore) all() []*client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*client, 0, len(s.byID))
+	for _, c := range s.byID {
+		list = append(list, c)
+	}
+	return list
+}
+
+func (s *sessionStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byID)
+}
+
+func (s *sessionStore) lookupName(name string) *client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byName[nameKey(name)]
+}
+
+// rename moves c to newName unless someone else has it, or one that looks
+// just like it (see nameKey)
+func (s *sessionStore) rename(c *client, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nameKey(newName)
+	if other, taken := s.byName[key]; taken && other != c {
+		if strings.EqualFold(other.Name(), newName) {
+			return errNameTaken
+		}
+		return fmt.Errorf("That name looks too much like %s's", other.Name())
+	}
+	c.mu.Lock()
+	oldName := c.name
+	c.name = newName
+	c.mu.Unlock()
+	if oldKey := nameKey(oldName); s.byName[oldKey] == c {
+		delete(s.byName, oldKey)
+	}
+	s.byName[key] = c
+	return nil
+}
+
+// issueToken gives c a new resume token in place of any old one
+func (s *sessionStore) issueToken(c *client) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byToken, c.token)
+	c.token = token
+	s.byToken[token] = c
+	return token, nil
+}
+
+func (s *sessionStore) lookupToken(token string) *client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byToken[token]
+}
+
+// replace puts next, which has taken over old's session, in old's place
+// under its name and forgets old without hanging up on it
+func (s *sessionStore) replace(old, next *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, old.id)
+	delete(s.byConn, old.conn)
+	delete(s.byToken, old.token)
+	old.token = ""
+	s.byName[nameKey(next.Name())] = next
+}
+
+// remove drops the session with the given id from every index and hangs up
+// its connection
+func (s *sessionStore) remove(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	c.hangUp()
+	delete(s.byID, id)
+	delete(s.byConn, c.conn)
+	delete(s.byToken, c.token)
+	if key := nameKey(c.Name()); s.byName[key] == c {
+		delete(s.byName, key)
+	}
+}
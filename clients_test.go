@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendDropOldest(t *testing.T) {
+	c := &client{out: make(chan string, 2), done: make(chan struct{})}
+	for _, message := range []string{"one", "two", "three"} {
+		c.send(message)
+	}
+	if first, second := <-c.out, <-c.out; first != "two" || second != "three" {
+		t.Errorf("queue kept %q and %q", first, second)
+	}
+	select {
+	case <-c.done:
+		t.Error("client was cut off under drop-oldest")
+	default:
+	}
+}
+
+func TestSendDisconnect(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SlowClient = disconnect
+	old := config()
+	liveConfig.Store(cfg)
+	defer liveConfig.Store(old)
+
+	server, remote := net.Pipe()
+	defer remote.Close()
+	c := &client{conn: server, out: make(chan string, 1), done: make(chan struct{})}
+	c.send("one")
+	c.send("two")
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("slow client wasn't cut off")
+	}
+	c.send("three")
+	if len(c.out) != 1 {
+		t.Errorf("%d messages queued after the client was cut off", len(c.out))
+	}
+}
+
+func TestWriteLoopFlushesOnHangUp(t *testing.T) {
+	server, remote := net.Pipe()
+	s := newSessionStore()
+	c := s.register(server)
+	c.send("one\n")
+	c.send("two\n")
+	c.hangUp()
+	c.send("three\n")
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "one\ntwo\n" {
+		t.Errorf("client got %q", got)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	server, remote := net.Pipe()
+	defer remote.Close()
+	s := newSessionStore()
+	c := s.register(server)
+	if s.register(server) != c {
+		t.Error("registering a connection twice made a second session")
+	}
+	if err := s.rename(c, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if s.get(c.id) != c || s.lookupName("alice") != c {
+		t.Fatal("session can't be found")
+	}
+	otherConn, otherRemote := net.Pipe()
+	defer otherRemote.Close()
+	other := s.register(otherConn)
+	if other.id == c.id {
+		t.Error("two sessions got the same id")
+	}
+	if err := s.rename(other, "ALICE"); err != errNameTaken {
+		t.Errorf("renaming to a look-alike of a taken name: %v", err)
+	}
+
+	s.remove(c.id)
+	if s.get(c.id) != nil || s.lookupName("alice") != nil {
+		t.Error("removed session can still be found")
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Error("removed session wasn't hung up")
+	}
+	other.hangUp()
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// cmdResult tells handleConnection what to do once a line has been processed
+type cmdResult int
+
+const (
+	// resultContinue means the line was dealt with, read the next one
+	resultContinue cmdResult = iota
+	// resultExit means the client has left its last group
+	resultExit
+	// resultBroadcast means the line is a chat message for the active group
+	resultBroadcast
+)
+
+// cmdScope says what a client needs before it may run a command
+type cmdScope int
+
+const (
+	scopeAnyone cmdScope = iota
+	scopeNamed
+	scopeInGroup
+)
+
+// command is one of the :name: commands clients can type. args names the
+// arguments in order, the last optional of them may be left out, and with
+// rest the last argument takes the remainder of the line as typed.
+type command struct {
+	name     string
+	aliases  []string
+	args     []string
+	optional int
+	rest     bool
+	help     string
+	scope    cmdScope
+	run      func(c *client, args []string) cmdResult
+}
+
+var (
+	commands     = make(map[string]*command)
+	commandOrder []*command
+)
+
+var (
+	errUnterminatedQuote = errors.New("missing closing quote")
+	errTooManyArgs       = errors.New("too many arguments")
+)
+
+func registerCommand(cmd *command) {
+	for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+		if _, taken := commands[name]; taken {
+			panic("command registered twice: " + name)
+		}
+		commands[name] = cmd
+	}
+	commandOrder = append(commandOrder, cmd)
+}
+
+// usage renders how the command is typed, e.g. ":chat: <name of group chat>"
+func (cmd *command) usage() string {
+	var b strings.Builder
+	b.WriteString(":" + cmd.name + ":")
+	for i, arg := range cmd.args {
+		if i >= len(cmd.args)-cmd.optional {
+			b.WriteString(" [" + arg + "]")
+		} else {
+			b.WriteString(" <" + arg + ">")
+		}
+	}
+	return b.String()
+}
+
+// helpText lists every command, it's what new clients are greeted with
+func helpText() string {
+	var b strings.Builder
+	for _, cmd := range commandOrder {
+		b.WriteString(BoldYellow + cmd.help + ":\n" + Reset + cmd.usage())
+		for _, alias := range cmd.aliases {
+			b.WriteString(Gray + " (or :" + alias + ":)" + Reset)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// parseCommand splits a line like ":chat: dev" into the command name and
+// the text after it. ok is false if the line isn't shaped like a command.
+func parseCommand(line string) (name, rest string, ok bool) {
+	if len(line) < 3 || line[0] != ':' {
+		return "", "", false
+	}
+	end := strings.IndexByte(line[1:], ':')
+	if end < 1 {
+		return "", "", false
+	}
+	name = line[1 : end+1]
+	if strings.ContainsAny(name, " \t") {
+		return "", "", false
+	}
+	rest = line[end+2:]
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(rest), true
+}
+
+// nextToken reads one whitespace separated argument off s. Double quotes
+// group words together and a backslash escapes the next character.
+func nextToken(s string) (token, rest string, err error) {
+	s = strings.TrimLeft(s, " \t")
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case ch == '"':
+			inQuote = !inQuote
+		case (ch == ' ' || ch == '\t') && !inQuote:
+			return b.String(), s[i:], nil
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	if inQuote {
+		return "", "", errUnterminatedQuote
+	}
+	return b.String(), "", nil
+}
+
+// parseArgs splits text into the command's arguments
+func (cmd *command) parseArgs(text string) ([]string, error) {
+	var args []string
+	for i := range cmd.args {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			break
+		}
+		if cmd.rest && i == len(cmd.args)-1 {
+			args = append(args, text)
+			text = ""
+			break
+		}
+		token, rest, err := nextToken(text)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, token)
+		text = rest
+	}
+	if strings.TrimSpace(text) != "" {
+		return nil, errTooManyArgs
+	}
+	if len(args) < len(cmd.args)-cmd.optional {
+		return nil, fmt.Errorf("missing %s", cmd.args[len(args)])
+	}
+	return args, nil
+}
+
+// processMessage runs msg if it's a command, otherwise it says whether the
+// message should go out to the client's active group
+func processMessage(msg string, cl *client) cmdResult {
+	name, text, ok := parseCommand(msg)
+	if !ok {
+		if cl.Name() == "" || cl.activeGroup() == "" {
+			return resultContinue
+		}
+		return resultBroadcast
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		cl.send(Red + "Unknown command :" + name + ":, type :help: to see them all\n" + Reset)
+		return resultContinue
+	}
+	switch {
+	case cmd.scope >= scopeNamed && cl.Name() == "":
+		cl.send(Red + "Pick a name before using :" + cmd.name + ":\n" + Reset)
+		return resultContinue
+	case cmd.scope >= scopeInGroup && cl.activeGroup() == "":
+		cl.send(Red + "Join a chat before using :" + cmd.name + ":\n" + Reset)
+		return resultContinue
+	}
+	args, err := cmd.parseArgs(text)
+	if err != nil {
+		cl.send(Red + "Invalid :" + cmd.name + ": (" + err.Error() + "), usage: " + cmd.usage() + "\n" + Reset)
+		return resultContinue
+	}
+	return cmd.run(cl, args)
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "chat",
+		aliases: []string{"join"},
+		args:    []string{"name of group chat"},
+		rest:    true,
+		help:    "To add/join a group chat",
+		run:     chatCommand,
+	})
+	registerCommand(&command{
+		name:  "name",
+		args:  []string{"new name"},
+		rest:  true,
+		help:  "To change your name",
+		scope: scopeNamed,
+		run:   nameCommand,
+	})
+	registerCommand(&command{
+		name:    "exit",
+		aliases: []string{"quit"},
+		help:    "To exit the current group chat",
+		scope:   scopeInGroup,
+		run: func(c *client, args []string) cmdResult {
+			return exitClient(c)
+		},
+	})
+	registerCommand(&command{
+		name:  "wait",
+		args:  []string{"name of group chat"},
+		rest:  true,
+		help:  "To get in line for a full group chat",
+		scope: scopeNamed,
+		run:   waitCommand,
+	})
+	registerCommand(&command{
+		name:     "cancel",
+		args:     []string{"name of group chat"},
+		optional: 1,
+		rest:     true,
+		help:     "To stop waiting for a group chat (or all of them)",
+		scope:    scopeNamed,
+		run:      cancelCommand,
+	})
+	registerCommand(&command{
+		name:  "switch",
+		args:  []string{"name of group chat"},
+		rest:  true,
+		help:  "To switch to another group chat you're in",
+		scope: scopeNamed,
+		run:   switchCommand,
+	})
+	registerCommand(&command{
+		name:  "leave",
+		args:  []string{"name of group chat"},
+		rest:  true,
+		help:  "To leave a group chat without exiting the current one",
+		scope: scopeInGroup,
+		run:   leaveCommand,
+	})
+	registerCommand(&command{
+		name:     "msg",
+		aliases:  []string{"dm"},
+		args:     []string{"user", "message"},
+		optional: 1,
+		rest:     true,
+		help:     "To send someone a private message (or read your messages with them)",
+		scope:    scopeNamed,
+		run:      msgCommand,
+	})
+	registerCommand(&command{
+		name:    "rooms",
+		aliases: []string{"list"},
+		help:    "To see every group chat",
+		run:     roomsCommand,
+	})
+	registerCommand(&command{
+		name:     "topic",
+		args:     []string{"new topic"},
+		optional: 1,
+		rest:     true,
+		help:     "To see or set the topic of this chat",
+		scope:    scopeInGroup,
+		run:      topicCommand,
+	})
+	registerCommand(&command{
+		name:  "who",
+		help:  "To see who is in this chat",
+		scope: scopeInGroup,
+		run:   whoCommand,
+	})
+	registerCommand(&command{
+		name:  "history",
+		args:  []string{"number of messages"},
+		help:  "To see the last messages of this chat",
+		scope: scopeInGroup,
+		run:   historyCommand,
+	})
+	registerCommand(&command{
+		name:  "more",
+		help:  "To see older messages",
+		scope: scopeInGroup,
+		run: func(c *client, args []string) cmdResult {
+			moreHistory(c)
+			return resultContinue
+		},
+	})
+	registerCommand(&command{
+		name:  "search",
+		args:  []string{"words"},
+		rest:  true,
+		help:  "To search this chat's messages (start with -all to search all your chats)",
+		scope: scopeInGroup,
+		run: func(c *client, args []string) cmdResult {
+			searchChat(c, args[0])
+			return resultContinue
+		},
+	})
+	registerCommand(&command{
+		name:  "register",
+		args:  []string{"password"},
+		rest:  true,
+		help:  "To register your name so only you can use it",
+		scope: scopeNamed,
+		run:   registerAccountCommand,
+	})
+	registerCommand(&command{
+		name:  "login",
+		args:  []string{"name", "password"},
+		rest:  true,
+		help:  "To log in to a registered name",
+		scope: scopeNamed,
+		run:   loginCommand,
+	})
+	registerCommand(&command{
+		name:  "reload",
+		help:  "To reload the server config (admins only)",
+		scope: scopeNamed,
+		run:   reloadCommand,
+	})
+	registerCommand(&command{
+		name:    "help",
+		aliases: []string{"?"},
+		help:    "To see this list again",
+		run: func(c *client, args []string) cmdResult {
+			c.send(helpText())
+			return resultContinue
+		},
+	})
+}
+
+func chatCommand(c *client, args []string) cmdResult {
+	if utf8.RuneCountInString(args[0]) == 1 {
+		c.send(Red + "Invalid chat name, 1 character isn't descriptive enough.\n" + Reset)
+	} else if sanitize(args[0]) != args[0] {
+		c.send(Red + "Invalid chat name, it has characters that aren't allowed\n" + Reset)
+	} else if strings.HasPrefix(args[0], dmPrefix) {
+		c.send(Red + "Chat names can't start with " + dmPrefix + ", use :msg: to talk to one person\n" + Reset)
+	} else {
+		joinChat(args[0], c)
+	}
+	return resultContinue
+}
+
+func waitCommand(c *client, args []string) cmdResult {
+	groupName := args[0]
+	r := findRoom(groupName)
+	if r == nil {
+		c.send(Red + groupName + " doesn't exist yet, use :chat: to start it\n" + Reset)
+		return resultContinue
+	}
+	position, err := r.wait(c.id)
+	switch err {
+	case errAlreadyMember:
+		c.send("YOU'RE ALREADY IN " + groupName + "\n")
+	case errNotFull:
+		joinChat(groupName, c)
+	case nil:
+		c.send(Gray + fmt.Sprintf("You're number %d in line for %s, :cancel: %s to give up\n", position, groupName, groupName) + Reset)
+	}
+	return resultContinue
+}
+
+func cancelCommand(c *client, args []string) cmdResult {
+	var list []*room
+	if len(args) == 0 {
+		list = allRooms()
+	} else if r := findRoom(args[0]); r != nil {
+		list = []*room{r}
+	}
+	cancelled := 0
+	for _, r := range list {
+		if r.cancelWait(c.id) == nil {
+			c.send(Yellow + "You're no longer waiting for " + r.name + "\n" + Reset)
+			cancelled++
+		}
+	}
+	if cancelled == 0 {
+		c.send(Gray + "You weren't waiting for anything\n" + Reset)
+	}
+	return resultContinue
+}
+
+func switchCommand(c *client, args []string) cmdResult {
+	switch {
+	case !c.isIn(args[0]):
+		c.send(Red + "You're not in " + args[0] + ", use :chat: to join it\n" + Reset)
+	case c.activeGroup() == args[0]:
+		c.send("YOU'RE ALREADY IN " + args[0] + "\n")
+	default:
+		switchChat(args[0], c)
+	}
+	return resultContinue
+}
+
+func leaveCommand(c *client, args []string) cmdResult {
+	if !c.isIn(args[0]) {
+		c.send(Red + "You're not in " + args[0] + "\n" + Reset)
+		return resultContinue
+	}
+	return leaveChat(args[0], c)
+}
+
+func nameCommand(c *client, args []string) cmdResult {
+	oldName, newName := c.Name(), args[0]
+	if newName == oldName {
+		c.send(Green + "You're already using that name, aren't you" + Reset + " :)\n")
+		return resultContinue
+	}
+	err := validateName(newName)
+	if err == nil && !c.mayUse(newName) {
+		c.send(Red + newName + " is registered, use :login: " + newName + " <password> if it's yours\n" + Reset)
+		return resultContinue
+	}
+	if err == nil {
+		err = sessions.rename(c, newName)
+	}
+	if err != nil {
+		c.send(Red + err.Error() + "\n" + Reset)
+		return resultContinue
+	}
+	renameClient(c, oldName, newName)
+	c.send(Green + "You've successfully changed your name\n" + Reset)
+	return resultContinue
+}
+
+// maxHistoryPage is the most messages :history: shows at once, :more: pages
+// back further
+const maxHistoryPage = 500
+
+func historyCommand(c *client, args []string) cmdResult {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		c.send(Red + "Usage: :history: <number of messages>\n" + Reset)
+		return resultContinue
+	}
+	n = min(n, maxHistoryPage)
+	groupName := c.activeGroup()
+	c.send(Gray + "--- last " + strconv.Itoa(n) + " messages in " + groupName + " ---\n" + Reset)
+	showHistory(c, groupName, 0, n)
+	return resultContinue
+}
+
+func reloadCommand(c *client, args []string) cmdResult {
+	if !config().isAdmin(c.Name()) {
+		c.send(Red + "Only admins can use :reload:\n" + Reset)
+		return resultContinue
+	}
+	if !c.loggedIn() {
+		c.send(Red + "Admins have to :register: and :login: before using :reload:\n" + Reset)
+		return resultContinue
+	}
+	if err := reloadConfig(); err != nil {
+		c.send(Red + "The config wasn't reloaded: " + err.Error() + "\n" + Reset)
+		return resultContinue
+	}
+	infof("%s reloaded the config", c.Name())
+	c.send(Green + "Config reloaded\n" + Reset)
+	return resultContinue
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line, name, rest string
+		ok               bool
+	}{
+		{":chat: dev team", "chat", "dev team", true},
+		{":exit:", "exit", "", true},
+		{":more:   ", "more", "", true},
+		{":) hello", "", "", false},
+		{"::", "", "", false},
+		{":chat:dev", "", "", false},
+		{"hi :chat: dev", "", "", false},
+		{":not a: command", "", "", false},
+	}
+	for _, tt := range tests {
+		name, rest, ok := parseCommand(tt.line)
+		if name != tt.name || rest != tt.rest || ok != tt.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v", tt.line, name, rest, ok)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	cmd := &command{name: "msg", args: []string{"user", "text"}, rest: true}
+	args, err := cmd.parseArgs(`"bob the builder"  can we fix it?`)
+	if err != nil || !reflect.DeepEqual(args, []string{"bob the builder", "can we fix it?"}) {
+		t.Errorf("rest args = %q, %v", args, err)
+	}
+	if _, err := cmd.parseArgs(`bob`); err == nil {
+		t.Error("missing argument wasn't reported")
+	}
+	if _, err := cmd.parseArgs(`"bob hi`); err != errUnterminatedQuote {
+		t.Errorf("unterminated quote gave %v", err)
+	}
+
+	cmd = &command{name: "history", args: []string{"n"}, optional: 1}
+	if args, err := cmd.parseArgs(""); err != nil || len(args) != 0 {
+		t.Errorf("optional args = %q, %v", args, err)
+	}
+	if _, err := cmd.parseArgs("1 2"); err != errTooManyArgs {
+		t.Errorf("extra args gave %v", err)
+	}
+	if got := cmd.usage(); got != ":history: [n]" {
+		t.Errorf("usage = %q", got)
+	}
+}
+
+func TestHistoryCommandCapsPage(t *testing.T) {
+	old := history
+	history = newMemoryHistory()
+	defer func() { history = old }()
+	for i := range maxHistoryPage + 10 {
+		history.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: strconv.Itoa(i)})
+	}
+	c := &client{
+		currActiveGroup: "global",
+		out:             make(chan string, 10),
+		done:            make(chan struct{}),
+		historyFrom:     make(map[string]int64),
+	}
+	historyCommand(c, []string{"9223372036854775807"})
+	<-c.out
+	got := <-c.out
+	if lines := strings.Count(got, "[alice]:"); lines != maxHistoryPage {
+		t.Errorf("huge :history: showed %d messages", lines)
+	}
+	if !strings.Contains(got, ":more:") || c.pageSize != maxHistoryPage {
+		t.Errorf("page of %d without a way to page back", c.pageSize)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net-cat/autocorrector"
+	"net-cat/basic"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var configPath = flag.String("config", "netcat.json", "JSON file with the server and room settings")
+
+// duration is a time.Duration written as "90s" or "24h" in the config file
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Set and String make a duration usable as a flag
+func (d *duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// roomSettings are the knobs of a single group chat. A zero field means
+// "use the server-wide default".
+type roomSettings struct {
+	MaxMembers     int      `json:"max_members,omitempty"`
+	Topic          string   `json:"topic,omitempty"`
+	Welcome        string   `json:"welcome,omitempty"`
+	BannerFont     string   `json:"banner_font,omitempty"`
+	HistoryMaxAge  duration `json:"history_max_age,omitempty"`
+	HistoryMaxMsgs int      `json:"history_max_messages,omitempty"`
+	WaitTimeout    duration `json:"wait_timeout,omitempty"`
+	// Filters names the message filters the room runs, an empty list
+	// turns off the defaults for a room
+	Filters []string `json:"filters,omitempty"`
+	// Profanity is what the profanity filter does about bad words: mask
+	// them, reject the message or warn, which masks them and gives the
+	// sender a strike. At StrikeLimit strikes the sender is disconnected.
+	Profanity   string `json:"profanity,omitempty"`
+	StrikeLimit int    `json:"strike_limit,omitempty"`
+	// Stages is what Filters used to be called. It's only read so a config
+	// still using it is told so instead of losing its filters.
+	Stages []string `json:"stages,omitempty"`
+}
+
+// rateLimit lets a client send Messages messages every Per, zero turns it off
+type rateLimit struct {
+	Messages int      `json:"messages"`
+	Per      duration `json:"per"`
+}
+
+// serverConfig is what the -config file holds. Every server setting can
+// also be given as a flag, which wins over the file.
+type serverConfig struct {
+	Listen          string    `json:"listen"`
+	DataDir         string    `json:"data_dir"`
+	LogLevel        string    `json:"log_level"`
+	MaxClients      int       `json:"max_clients"`
+	DefaultRoom     string    `json:"default_room"`
+	Logo            string    `json:"logo"`
+	BannersDir      string    `json:"banners_dir"`
+	Colors          bool      `json:"colors"`
+	QueueSize       int       `json:"queue_size"`
+	SlowClient      string    `json:"slow_client"`
+	WriteTimeout    duration  `json:"write_timeout"`
+	ShutdownTimeout duration  `json:"shutdown_timeout"`
+	Replay          int       `json:"replay"`
+	ResumeGrace     duration  `json:"resume_grace"`
+	MOTD            string    `json:"motd"`
+	BannedWords     string    `json:"banned_words"`
+	RateLimit       rateLimit `json:"rate_limit"`
+	Admins          []string  `json:"admins"`
+	// Chars is the character policy of names and messages
+	Chars charPolicy `json:"chars"`
+	Names namePolicy `json:"names"`
+	// TLS is the encrypted listener, which runs next to the plain one or
+	// instead of it if listen is empty
+	TLS tlsSettings `json:"tls"`
+
+	RoomDefaults roomSettings            `json:"room_defaults"`
+	Rooms        map[string]roomSettings `json:"rooms"`
+}
+
+// liveConfig is swapped as a whole on reload, so readers always see one
+// consistent config
+var liveConfig atomic.Pointer[serverConfig]
+
+func init() {
+	liveConfig.Store(defaultConfig())
+}
+
+// config returns the settings the server is running with right now
+func config() *serverConfig {
+	return liveConfig.Load()
+}
+
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		Listen:          ":8989",
+		DataDir:         "data",
+		LogLevel:        "info",
+		DefaultRoom:     "global",
+		Logo:            "linuxlogo.txt",
+		BannersDir:      "banners",
+		Colors:          true,
+		QueueSize:       256,
+		SlowClient:      dropOldest,
+		WriteTimeout:    duration(10 * time.Second),
+		ShutdownTimeout: duration(5 * time.Second),
+		Replay:          20,
+		ResumeGrace:     duration(2 * time.Minute),
+		BannedWords:     "autocorrector/words.json",
+		Names:           defaultNamePolicy(),
+		TLS:             tlsSettings{Cert: "cert.pem", Key: "key.pem"},
+		RoomDefaults:    roomSettings{MaxMembers: 10, WaitTimeout: duration(10 * time.Minute)},
+		Rooms:           make(map[string]roomSettings),
+	}
+}
+
+// bindFlags defines a flag for every server setting on fs, writing into cfg
+func bindFlags(fs *flag.FlagSet, cfg *serverConfig) {
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address to accept clients on")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory the chat history is kept in")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "least important log lines to print: debug, info, warn or error")
+	fs.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "how many clients may be connected at once (0 for no limit)")
+	fs.StringVar(&cfg.DefaultRoom, "default-room", cfg.DefaultRoom, "group chat new clients are added to")
+	fs.StringVar(&cfg.Logo, "logo", cfg.Logo, "file shown when joining the default room")
+	fs.StringVar(&cfg.BannersDir, "banners-dir", cfg.BannersDir, "directory with the banner fonts")
+	fs.BoolVar(&cfg.Colors, "colors", cfg.Colors, "color the text sent to clients")
+	fs.IntVar(&cfg.QueueSize, "queue", cfg.QueueSize, "messages buffered per client before the slow-client policy applies")
+	fs.StringVar(&cfg.SlowClient, "slow-client", cfg.SlowClient, "what to do when a client's queue is full: "+dropOldest+" or "+disconnect)
+	fs.Var(&cfg.WriteTimeout, "write-timeout", "how long a single write to a client may take")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "how long to wait for clients to drain on shutdown")
+	fs.IntVar(&cfg.Replay, "replay", cfg.Replay, "how many records a client is shown when it joins a room")
+	fs.Var(&cfg.ResumeGrace, "resume-grace", "how long a dropped client's session is kept for it to resume (0 ends it right away)")
+	fs.StringVar(&cfg.MOTD, "motd", cfg.MOTD, "message of the day shown to every client that connects")
+	fs.StringVar(&cfg.BannedWords, "banned-words", cfg.BannedWords, "JSON list of words to filter out of messages")
+	fs.StringVar(&cfg.TLS.Listen, "tls-listen", cfg.TLS.Listen, "address to accept TLS clients on (empty for none)")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "PEM certificate of the TLS listener")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "PEM private key of the TLS listener")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA, "PEM CA that signs client certificates, whose common name becomes the client's name")
+	fs.BoolVar(&cfg.TLS.RequireClientCert, "tls-require-client-cert", cfg.TLS.RequireClientCert, "turn away TLS clients without a certificate from -tls-client-ca")
+	fs.Var(&cfg.RoomDefaults.HistoryMaxAge, "history-max-age", "drop history older than this (0 keeps it forever)")
+	fs.IntVar(&cfg.RoomDefaults.HistoryMaxMsgs, "history-max-messages", cfg.RoomDefaults.HistoryMaxMsgs, "keep at most this many records per room (0 keeps them all)")
+}
+
+func init() {
+	bindFlags(flag.CommandLine, defaultConfig())
+}
+
+// loadConfig reads the config file at path, anything it leaves out keeps
+// its default. A missing file is only an error if it was asked for
+// explicitly.
+func loadConfig(path string, explicit bool) (*serverConfig, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Rooms == nil {
+		cfg.Rooms = make(map[string]roomSettings)
+	}
+	return cfg, nil
+}
+
+// applyFlags copies the flags that were set in set, the command line's
+// outside of tests, over cfg
+func applyFlags(set *flag.FlagSet, cfg *serverConfig) error {
+	fs := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bindFlags(fs, cfg)
+	var err error
+	set.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil && err == nil {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// validate reports the first setting that doesn't make sense. It also
+// compiles the character policy.
+func (cfg *serverConfig) validate() error {
+	switch {
+	case cfg.Listen == "" && cfg.TLS.Listen == "":
+		return errors.New("listen and tls.listen can't both be empty")
+	case cfg.DataDir == "":
+		return errors.New("data_dir can't be empty")
+	case cfg.MaxClients < 0:
+		return errors.New("max_clients can't be negative")
+	case len(cfg.DefaultRoom) < 2 || strings.HasPrefix(cfg.DefaultRoom, dmPrefix):
+		return fmt.Errorf("default_room %q isn't a valid chat name", cfg.DefaultRoom)
+	case cfg.QueueSize < 1:
+		return errors.New("queue_size must be at least 1")
+	case cfg.SlowClient != dropOldest && cfg.SlowClient != disconnect:
+		return errors.New("slow_client must be " + dropOldest + " or " + disconnect)
+	case cfg.WriteTimeout <= 0 || cfg.ShutdownTimeout <= 0:
+		return errors.New("write_timeout and shutdown_timeout must be positive")
+	case cfg.Replay < 1:
+		return errors.New("replay must be at least 1")
+	case cfg.ResumeGrace < 0:
+		return errors.New("resume_grace can't be negative")
+	case cfg.RateLimit.Messages < 0 || cfg.RateLimit.Per < 0:
+		return errors.New("rate_limit can't be negative")
+	case cfg.RateLimit.Messages > 0 && cfg.RateLimit.Per == 0:
+		return errors.New("rate_limit needs a per duration")
+	case cfg.RoomDefaults.MaxMembers < 1:
+		// a room's own 0 means "the default", so this is the one place it
+		// can be said and it would leave every room full
+		return errors.New("room_defaults.max_members must be at least 1")
+	case cfg.Names.MinLength < 1 || cfg.Names.MaxLength < cfg.Names.MinLength:
+		return errors.New("names need a min_length of at least 1 and a max_length no smaller")
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if err := cfg.TLS.check(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if err := cfg.Chars.compile(); err != nil {
+		return fmt.Errorf("chars: %w", err)
+	}
+	if _, err := os.Stat(cfg.Logo); err != nil {
+		return fmt.Errorf("logo: %w", err)
+	}
+	if err := cfg.checkRoomSettings(cfg.RoomDefaults); err != nil {
+		return fmt.Errorf("room_defaults: %w", err)
+	}
+	for name, s := range cfg.Rooms {
+		if err := cfg.checkRoomSettings(s); err != nil {
+			return fmt.Errorf("room %q: %w", name, err)
+		}
+	}
+	// nobody can log in under a reserved name, so such an admin would never
+	// get to use their commands
+	for _, admin := range cfg.Admins {
+		for _, reserved := range cfg.Names.Reserved {
+			if nameKey(admin) == nameKey(reserved) {
+				return fmt.Errorf("admin %q has a reserved name", admin)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *serverConfig) checkRoomSettings(s roomSettings) error {
+	if s.Stages != nil {
+		return errors.New(`"stages" is called "filters" now`)
+	}
+	if s.MaxMembers < 0 || s.HistoryMaxAge < 0 || s.HistoryMaxMsgs < 0 || s.WaitTimeout < 0 || s.StrikeLimit < 0 {
+		return errors.New("settings can't be negative")
+	}
+	switch s.Profanity {
+	case "", policyMask, policyReject, policyWarn:
+	default:
+		return fmt.Errorf("profanity must be %s, %s or %s", policyMask, policyReject, policyWarn)
+	}
+	if s.BannerFont != "" {
+		if _, err := os.Stat(filepath.Join(cfg.BannersDir, s.BannerFont+".txt")); err != nil {
+			return fmt.Errorf("unknown banner font %q", s.BannerFont)
+		}
+	}
+	return checkFilters(s.Filters)
+}
+
+// startPort is the positional argument of `./TCPChat $port`, if there was
+// one. It keeps winning over the config file on reload.
+var startPort string
+
+// readConfig loads the -config file, puts the command line on top of it and
+// checks the result
+func readConfig() (*serverConfig, error) {
+	cfg, err := readSettings()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", *configPath, err)
+	}
+	return cfg, nil
+}
+
+// readSettings is readConfig without the checks
+func readSettings() (*serverConfig, error) {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	cfg, err := loadConfig(*configPath, explicit)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyFlags(flag.CommandLine, cfg); err != nil {
+		return nil, err
+	}
+	if startPort != "" {
+		cfg.Listen = ":" + startPort
+	}
+	return cfg, nil
+}
+
+// openConfig sets the server up from the config, exiting if it's broken
+func openConfig(port string) {
+	startPort = port
+	cfg, err := readConfig()
+	errorCheck("Error loading the config:", err)
+	errorCheck("Error loading the banned words:", autocorrector.LoadBadWords(cfg.BannedWords))
+	liveConfig.Store(cfg)
+	level, _ := parseLogLevel(cfg.LogLevel)
+	setLogLevel(level)
+	basic.BannersDir = cfg.BannersDir
+	if !cfg.Colors {
+		disableColors()
+	}
+	infof("Loaded %d room setting(s) from %s", len(cfg.Rooms), *configPath)
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig reads the config again and applies it to the running server.
+// If anything is wrong with it the old config stays in place.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old := config()
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	// these are baked into the listeners, the history files and the colors
+	// every client has been sent, so they only change on a restart
+	if cfg.Listen != old.Listen || cfg.TLS != old.TLS || cfg.DataDir != old.DataDir || cfg.BannersDir != old.BannersDir || cfg.Colors != old.Colors {
+		warnf("listen, tls, data_dir, banners_dir and colors only change on a restart")
+		cfg.Listen, cfg.TLS, cfg.DataDir, cfg.BannersDir, cfg.Colors = old.Listen, old.TLS, old.DataDir, old.BannersDir, old.Colors
+	}
+	if err := autocorrector.LoadBadWords(cfg.BannedWords); err != nil {
+		return fmt.Errorf("%s: %w", cfg.BannedWords, err)
+	}
+	liveConfig.Store(cfg)
+	level, _ := parseLogLevel(cfg.LogLevel)
+	setLogLevel(level)
+
+	for _, r := range allRooms() {
+		r.reconfigure(cfg.settingsFor(r.name), old.settingsFor(r.name).Topic)
+	}
+	// retention may have tightened
+	pruneHistory()
+	if cfg.MOTD != old.MOTD && cfg.MOTD != "" {
+		for _, c := range sessions.all() {
+			c.send(BoldMagenta + cfg.MOTD + "\n" + Reset)
+		}
+	}
+	infof("Reloaded %s, %d room setting(s)", *configPath, len(cfg.Rooms))
+	return nil
+}
+
+// isAdmin says whether name may run the admin commands
+func (cfg *serverConfig) isAdmin(name string) bool {
+	return name != "" && slices.Contains(cfg.Admins, name)
+}
+
+// settingsFor returns the settings of a room, its own on top of the defaults
+func (cfg *serverConfig) settingsFor(room string) roomSettings {
+	s := cfg.RoomDefaults
+	own, ok := cfg.Rooms[room]
+	if !ok {
+		return s
+	}
+	if own.MaxMembers != 0 {
+		s.MaxMembers = own.MaxMembers
+	}
+	if own.Topic != "" {
+		s.Topic = own.Topic
+	}
+	if own.Welcome != "" {
+		s.Welcome = own.Welcome
+	}
+	if own.BannerFont != "" {
+		s.BannerFont = own.BannerFont
+	}
+	if own.HistoryMaxAge != 0 {
+		s.HistoryMaxAge = own.HistoryMaxAge
+	}
+	if own.HistoryMaxMsgs != 0 {
+		s.HistoryMaxMsgs = own.HistoryMaxMsgs
+	}
+	if own.WaitTimeout != 0 {
+		s.WaitTimeout = own.WaitTimeout
+	}
+	if own.Filters != nil {
+		s.Filters = own.Filters
+	}
+	if own.Profanity != "" {
+		s.Profanity = own.Profanity
+	}
+	if own.StrikeLimit != 0 {
+		s.StrikeLimit = own.StrikeLimit
+	}
+	return s
+}
+
+// retention tells the history how much of a room to keep
+func (cfg *serverConfig) retention(room string) (time.Duration, int) {
+	s := cfg.settingsFor(room)
+	return time.Duration(s.HistoryMaxAge), s.HistoryMaxMsgs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netcat.json")
+	os.WriteFile(path, []byte(`{
+		"room_defaults": {"history_max_messages": 100},
+		"rooms": {"standup": {"max_members": 40, "topic": "yesterday/today", "history_max_age": "24h"}}
+	}`), 0644)
+
+	cfg, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8989" || cfg.DefaultRoom != "global" || !cfg.Colors {
+		t.Errorf("server defaults lost: %+v", cfg)
+	}
+	s := cfg.settingsFor("standup")
+	if s.MaxMembers != 40 || s.Topic != "yesterday/today" || s.HistoryMaxMsgs != 100 {
+		t.Errorf("standup settings = %+v", s)
+	}
+	if maxAge, n := cfg.retention("standup"); maxAge != 24*time.Hour || n != 100 {
+		t.Errorf("standup retention = %v, %d", maxAge, n)
+	}
+	if s := cfg.settingsFor("random"); s.MaxMembers != 10 || s.Topic != "" {
+		t.Errorf("default settings = %+v", s)
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.json"), false); err != nil {
+		t.Errorf("missing default config: %v", err)
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.json"), true); err == nil {
+		t.Error("missing explicit config wasn't reported")
+	}
+	for _, bad := range []string{
+		`{"rooms": {"x": {"max_members": -1}}}`,
+		`{"slow_client": "ignore"}`,
+		`{"log_level": "loud"}`,
+		`{"default_room": "@x"}`,
+		`{"replay": 0}`,
+		`{"admins": ["Root"]}`,
+		`{"room_defaults": {"max_members": 0}}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0644)
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Logo = path
+		if cfg.validate() == nil {
+			t.Errorf("%s wasn't reported", bad)
+		}
+	}
+}
+
+func TestApplyFlags(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	bindFlags(set, defaultConfig())
+	if err := set.Parse([]string{"-listen", ":7000", "-history-max-age", "1h", "-colors=false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.MaxClients = 3
+	if err := applyFlags(set, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":7000" || cfg.RoomDefaults.HistoryMaxAge != duration(time.Hour) || cfg.Colors {
+		t.Errorf("flags not applied: %+v", cfg)
+	}
+	if cfg.MaxClients != 3 {
+		t.Errorf("unset flag overrode max_clients: %d", cfg.MaxClients)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := &client{}
+	limit := rateLimit{Messages: 2, Per: duration(time.Hour)}
+	if !c.allow(limit) || !c.allow(limit) {
+		t.Fatal("messages within the limit were refused")
+	}
+	if c.allow(limit) {
+		t.Error("third message in the window was allowed")
+	}
+	if !c.allow(rateLimit{}) {
+		t.Error("a zero rate limit refused a message")
+	}
+}
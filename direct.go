@@ -0,0 +1,78 @@
+package main
+
+import "strings"
+
+// dmPrefix starts the room name direct messages are kept under, group chats
+// can't use it
+const dmPrefix = "@"
+
+// dmRoom names the conversation between two parties (see dmParty) the same
+// way whichever of them is asking
+func dmRoom(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return dmPrefix + a + "," + b
+}
+
+// dmParty is who c is in a conversation: its account when it's logged in,
+// its session otherwise. Not its name, or whoever takes the name next could
+// read what was said under it.
+func dmParty(c *client) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.account != "" && nameKey(c.account) == nameKey(c.name) {
+		return "~" + nameKey(c.account)
+	}
+	return "#" + c.sessionKey
+}
+
+func msgCommand(c *client, args []string) cmdResult {
+	sender := c.Name()
+	to := sessions.lookupName(args[0])
+	if to == nil || to.Name() == "" {
+		c.send(Red + "Nobody called " + args[0] + " is online\n" + Reset)
+		return resultContinue
+	}
+	if to == c {
+		c.send(Red + "Talking to yourself? Try a notebook " + Reset + ":)\n")
+		return resultContinue
+	}
+	conversation := dmRoom(dmParty(c), dmParty(to))
+
+	if len(args) == 1 {
+		readDirect(c, conversation)
+		return resultContinue
+	}
+	text := sanitize(args[1])
+	if text == "" || overLimit(c) {
+		return resultContinue
+	}
+	msg := &Message{Room: conversation, Sender: sender, To: to.Name(), Body: text, from: c}
+	if !filterMessage(c, msg) {
+		return resultContinue
+	}
+	rec := saveChat(Record{Room: conversation, Sender: sender, To: msg.To, Kind: kindDirect, Body: msg.Body, Notes: msg.Notes})
+	message := render(rec)
+	c.send(message)
+	if to.deliverDirect(conversation, c.activeGroup(), message) {
+		to.send(Cyan + "New direct message from " + sender + ", type :msg: " + sender + " to read it\n" + Reset)
+	}
+	return resultContinue
+}
+
+// readDirect shows c the latest of a conversation, including whatever was
+// waiting in its pendingConv
+func readDirect(c *client, conversation string) {
+	c.takePending(conversation)
+	records, err := history.Page(conversation, 0, config().Replay)
+	if err != nil || len(records) == 0 {
+		c.send(Gray + "No direct messages yet\n" + Reset)
+		return
+	}
+	var b strings.Builder
+	for _, rec := range records {
+		b.WriteString(render(rec))
+	}
+	c.send(b.String())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDMParty(t *testing.T) {
+	s := newSessionStore()
+	register := func() *client {
+		conn, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return s.register(conn)
+	}
+	alice, bob := register(), register()
+	s.rename(alice, "alice")
+	s.rename(bob, "bob")
+	first := dmRoom(dmParty(alice), dmParty(bob))
+	if first != dmRoom(dmParty(bob), dmParty(alice)) {
+		t.Error("the two sides see different conversations")
+	}
+
+	// someone else taking the name later doesn't get the conversation
+	s.remove(alice.id)
+	impostor := register()
+	s.rename(impostor, "alice")
+	if dmRoom(dmParty(impostor), dmParty(bob)) == first {
+		t.Error("a new session with the same name got the old conversation")
+	}
+
+	// an account's conversations follow it from session to session
+	impostor.loginSucceeded("alice")
+	loggedIn := dmRoom(dmParty(impostor), dmParty(bob))
+	s.remove(impostor.id)
+	again := register()
+	s.rename(again, "Alice")
+	again.loginSucceeded("alice")
+	if dmRoom(dmParty(again), dmParty(bob)) != loggedIn {
+		t.Error("logging in again didn't get back the account's conversation")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net-cat/autocorrector"
+)
+
+// Message is a chat or direct message on its way from the sender to the
+// room. To is only set for direct messages.
+type Message struct {
+	Room   string
+	Sender string
+	To     string
+	Body   string
+	Notes  []string
+	// from is the sender's session
+	from *client
+}
+
+// Annotate adds a note that is shown under the message
+func (m *Message) Annotate(note string) {
+	m.Notes = append(m.Notes, note)
+}
+
+// MessageFilter looks at a message before it's saved and sent. It may
+// change the Body, Annotate the message, or return an error to reject it,
+// in which case the sender is told the error and nobody else sees it.
+type MessageFilter interface {
+	Filter(msg *Message) error
+}
+
+// FilterFunc lets an ordinary function be a MessageFilter
+type FilterFunc func(msg *Message) error
+
+func (f FilterFunc) Filter(msg *Message) error {
+	return f(msg)
+}
+
+// rewrite turns a transform of the text into a MessageFilter
+func rewrite(transform func(string) string) MessageFilter {
+	return FilterFunc(func(msg *Message) error {
+		msg.Body = transform(msg.Body)
+		return nil
+	})
+}
+
+type namedFilter struct {
+	name   string
+	filter MessageFilter
+}
+
+// registeredFilters holds every filter rooms can turn on. A room runs the
+// ones its "filters" setting names, in the order it names them.
+var registeredFilters []namedFilter
+
+// registerFilter adds a filter rooms can turn on by name. Filters are
+// registered from init functions, so adding one doesn't mean touching the
+// rest of the server.
+func registerFilter(name string, f MessageFilter) {
+	if findFilter(name) != nil {
+		panic("filter registered twice: " + name)
+	}
+	registeredFilters = append(registeredFilters, namedFilter{name, f})
+}
+
+func findFilter(name string) MessageFilter {
+	for _, nf := range registeredFilters {
+		if nf.name == name {
+			return nf.filter
+		}
+	}
+	return nil
+}
+
+func checkFilters(names []string) error {
+	for _, name := range names {
+		if findFilter(name) == nil {
+			return fmt.Errorf("unknown filter %q", name)
+		}
+	}
+	return nil
+}
+
+// runFilters passes msg through the filters its room has turned on, in the
+// room's order, and stops at the first one that rejects it
+func runFilters(msg *Message) error {
+	for _, name := range config().settingsFor(msg.Room).Filters {
+		f := findFilter(name)
+		if f == nil {
+			continue
+		}
+		if err := f.Filter(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerFilter("manipulate", FilterFunc(func(msg *Message) error {
+		body, err := autocorrector.ApplyMarkers(msg.Body)
+		if err != nil {
+			return err
+		}
+		msg.Body = body
+		return nil
+	}))
+	registerFilter("punctuate", rewrite(autocorrector.Punctuate))
+	registerFilter("quotes", rewrite(autocorrector.FixQuotes))
+	registerFilter("profanity", FilterFunc(profanityFilter))
+}
+
+const (
+	policyMask   = "mask"
+	policyReject = "reject"
+	policyWarn   = "warn"
+)
+
+// profanityFilter deals with bad words as the room's profanity policy says
+func profanityFilter(msg *Message) error {
+	found := autocorrector.FindBadWords(msg.Body)
+	if len(found) == 0 {
+		return nil
+	}
+	settings := config().settingsFor(msg.Room)
+	switch settings.Profanity {
+	case policyReject:
+		return errors.New("that language isn't allowed in " + msg.Room)
+	case policyWarn:
+		msg.Body = autocorrector.MaskBadWords(msg.Body)
+		if msg.from == nil {
+			return nil
+		}
+		strikes := msg.from.strike()
+		if settings.StrikeLimit > 0 && strikes >= settings.StrikeLimit {
+			warnf("Disconnecting %s after %d strikes for bad language", msg.Sender, strikes)
+			msg.from.send(Red + fmt.Sprintf("That was strike %d, you're being disconnected for your language\n", strikes) + Reset)
+			msg.from.kick()
+			msg.Body = ""
+			return nil
+		}
+		warning := fmt.Sprintf("Mind your language, that's strike %d", strikes)
+		if settings.StrikeLimit > 0 {
+			warning += fmt.Sprintf(" of %d", settings.StrikeLimit)
+		}
+		msg.from.send(Yellow + warning + "\n" + Reset)
+	default:
+		msg.Body = autocorrector.MaskBadWords(msg.Body)
+	}
+	return nil
+}
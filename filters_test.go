@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net-cat/autocorrector"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFilters(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RoomDefaults.Filters = []string{"profanity", "manipulate", "punctuate"}
+	cfg.Rooms["raw"] = roomSettings{Filters: []string{}}
+	cfg.Rooms["strict"] = roomSettings{Filters: []string{"manipulate", "test-reject"}}
+	cfg.Rooms["early"] = roomSettings{Filters: []string{"test-reject", "manipulate"}}
+	old := config()
+	liveConfig.Store(cfg)
+	defer liveConfig.Store(old)
+
+	msg := &Message{Room: "global", Body: "it was a apple (up) ,really"}
+	if err := runFilters(msg); err != nil || msg.Body != "it was an APPLE, really" {
+		t.Errorf("default filters gave %q, %v", msg.Body, err)
+	}
+	msg = &Message{Room: "raw", Body: "a apple (up)"}
+	if runFilters(msg); msg.Body != "a apple (up)" {
+		t.Errorf("room without filters gave %q", msg.Body)
+	}
+	// filters run in the room's order, so test-reject sees what manipulate
+	// made of the message only if it comes after it
+	msg = &Message{Room: "strict", Body: "a owl"}
+	if err := runFilters(msg); err == nil || msg.Body != "an owl" {
+		t.Errorf("rejecting filter let %q through", msg.Body)
+	}
+	msg = &Message{Room: "early", Body: "a owl"}
+	if err := runFilters(msg); err == nil || msg.Body != "a owl" {
+		t.Errorf("filter listed first ran after manipulate: %q", msg.Body)
+	}
+	msg = &Message{Room: "strict", Body: "fine (up)"}
+	if err := runFilters(msg); err != nil || msg.Body != "FINE" || len(msg.Notes) != 1 {
+		t.Errorf("annotated message = %+v, %v", msg, err)
+	}
+	if !strings.Contains(render(Record{Kind: kindMessage, Body: msg.Body, Notes: msg.Notes}), "  > checked\n") {
+		t.Error("note wasn't rendered")
+	}
+
+	if cfg.checkRoomSettings(roomSettings{Filters: []string{"translate"}}) == nil {
+		t.Error("unknown filter wasn't reported")
+	}
+
+	var oldStyle roomSettings
+	if err := json.Unmarshal([]byte(`{"stages": ["manipulate"]}`), &oldStyle); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.checkRoomSettings(oldStyle); err == nil || !strings.Contains(err.Error(), "stages") {
+		t.Errorf("old stages key: %v", err)
+	}
+}
+
+func TestProfanityPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.json")
+	os.WriteFile(path, []byte(`["darn", "heck no"]`), 0644)
+	if err := autocorrector.LoadBadWords(path); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.RoomDefaults.Filters = []string{"profanity"}
+	cfg.Rooms["strict"] = roomSettings{Profanity: policyReject}
+	cfg.Rooms["warned"] = roomSettings{Profanity: policyWarn, StrikeLimit: 2}
+	old := config()
+	liveConfig.Store(cfg)
+	defer liveConfig.Store(old)
+
+	msg := &Message{Room: "global", Body: "Heck  no, DARN it"}
+	if runFilters(msg); msg.Body != "H***  **, D*** it" {
+		t.Errorf("masked %q", msg.Body)
+	}
+	if err := runFilters(&Message{Room: "strict", Body: "darn"}); err == nil {
+		t.Error("strict room let a bad word through")
+	}
+
+	c := &client{out: make(chan string, 10), done: make(chan struct{})}
+	msg = &Message{Room: "warned", Body: "darn", from: c}
+	if runFilters(msg); msg.Body != "d***" || c.strikes != 1 {
+		t.Errorf("first warning: %q, %d strikes", msg.Body, c.strikes)
+	}
+	msg = &Message{Room: "warned", Body: "darn", from: c}
+	runFilters(msg)
+	select {
+	case <-c.done:
+	default:
+		t.Error("client wasn't disconnected at the strike limit")
+	}
+	if msg.Body != "" {
+		t.Errorf("message at the strike limit was kept: %q", msg.Body)
+	}
+}
+
+func init() {
+	registerFilter("test-reject", FilterFunc(func(msg *Message) error {
+		if strings.Contains(msg.Body, "owl") {
+			return errors.New("no owls")
+		}
+		msg.Annotate("checked")
+		return nil
+	}))
+}
@@ -7,6 +7,7 @@ toolchain go1.23.3
 require (
 	github.com/atouba/piscine v0.0.0-20240912123319-f8b51fa00b6c
 	github.com/jroimartin/gocui v0.5.0
+	golang.org/x/crypto v0.41.0
 )
 
 require (
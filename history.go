@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var wipeOnBoot = flag.Bool("wipe", false, "delete all chat history on startup")
+
+type recordKind string
+
+const (
+	kindMessage recordKind = "message"
+	kindJoin    recordKind = "join"
+	kindLeave   recordKind = "leave"
+	kindRename  recordKind = "rename"
+	kindDirect  recordKind = "direct"
+	kindTopic   recordKind = "topic"
+)
+
+// Record is one thing that happened in a room. For a rename Sender is the
+// old name and Body the new one. Direct messages are kept in a room named
+// after the conversation (see dmRoom) and say who they were sent To.
+type Record struct {
+	ID     int64      `json:"id"`
+	Room   string     `json:"room"`
+	Sender string     `json:"sender"`
+	To     string     `json:"to,omitempty"`
+	Time   time.Time  `json:"time"`
+	Kind   recordKind `json:"kind"`
+	Body   string     `json:"body"`
+	Notes  []string   `json:"notes,omitempty"`
+}
+
+// HistoryStore keeps the records of every room. Append fills in the
+// record's ID (and Time, if it's zero) and returns the stored record.
+// Page returns, oldest first, up to n of the room's records with an ID
+// below before, or the newest n when before is 0.
+type HistoryStore interface {
+	Append(rec Record) (Record, error)
+	Load(room string) ([]Record, error)
+	Page(room string, before int64, n int) ([]Record, error)
+	Close() error
+}
+
+var history HistoryStore
+
+// render turns a record into the colored line clients see
+func render(rec Record) string {
+	switch rec.Kind {
+	case kindJoin:
+		return Magenta + fmt.Sprintf("%s has joined %s...\n", rec.Sender, rec.Room) + Reset
+	case kindLeave:
+		return Yellow + fmt.Sprintf("%s has left our chat...\n", rec.Sender) + Reset
+	case kindRename:
+		return Blue + "Heads up! [" + rec.Sender + "] is now going by [" + rec.Body + "].\n" + Reset
+	case kindTopic:
+		return Cyan + rec.Sender + " set the topic to: " + Reset + rec.Body + "\n"
+	case kindDirect:
+		return Cyan + fmt.Sprintf("[%s][%s -> %s]:", rec.Time.Format("2006-01-02 15:04:05"), rec.Sender, rec.To) + Reset + rec.Body + "\n" + renderNotes(rec.Notes)
+	default:
+		return fmt.Sprintf("[%s][%s]:%s\n", rec.Time.Format("2006-01-02 15:04:05"), rec.Sender, rec.Body) + renderNotes(rec.Notes)
+	}
+}
+
+// renderNotes shows what the message filters had to say about a message
+func renderNotes(notes []string) string {
+	var b strings.Builder
+	for _, note := range notes {
+		b.WriteString(Gray + "  > " + note + "\n" + Reset)
+	}
+	return b.String()
+}
+
+// page picks, from records sorted by ID, the last n with an ID below before
+func page(records []Record, before int64, n int) []Record {
+	end := len(records)
+	if before > 0 {
+		end = sort.Search(len(records), func(i int) bool { return records[i].ID >= before })
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	return records[start:end]
+}
+
+// memoryHistory is a HistoryStore that only lives as long as the process
+type memoryHistory struct {
+	mu      sync.Mutex
+	lastID  int64
+	records map[string][]Record
+}
+
+func newMemoryHistory() *memoryHistory {
+	return &memoryHistory{records: make(map[string][]Record)}
+}
+
+func (m *memoryHistory) Append(rec Record) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	rec.ID = m.lastID
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	m.records[rec.Room] = append(m.records[rec.Room], rec)
+	return rec, nil
+}
+
+func (m *memoryHistory) Load(room string) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Record(nil), m.records[room]...), nil
+}
+
+func (m *memoryHistory) Page(room string, before int64, n int) ([]Record, error) {
+	records, err := m.Load(room)
+	return page(records, before, n), err
+}
+
+func (m *memoryHistory) Close() error {
+	return nil
+}
+
+const historyExt = ".jsonl"
+
+// retentionFunc says how old and how many records of a room to keep, zero
+// meaning no limit
+type retentionFunc func(room string) (maxAge time.Duration, maxMessages int)
+
+// keepFor is a retentionFunc that treats every room the same
+func keepFor(maxAge time.Duration, maxMessages int) retentionFunc {
+	return func(string) (time.Duration, int) { return maxAge, maxMessages }
+}
+
+// fileHistory keeps each room's records in its own JSON-lines file under
+// dir. Retention is applied when a room is loaded or paged and by prune.
+// Page reads the file backwards from the end, so it only decodes the
+// records it's after and those newer than them, however old the room is.
+// Files are only open while they're read or written: rooms are named by
+// users, so keeping one open per room would let anyone run the server out
+// of file descriptors.
+type fileHistory struct {
+	dir       string
+	retention retentionFunc
+
+	mu     sync.Mutex
+	lastID int64
+}
+
+func newFileHistory(dir string, retention retentionFunc) (*fileHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &fileHistory{dir: dir, retention: retention}
+	for _, room := range h.rooms() {
+		err := h.readBackward(room, func(rec Record) bool {
+			if rec.ID > h.lastID {
+				h.lastID = rec.ID
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// path returns the file a room is kept in. Room names come from users, so
+// they're escaped to keep them from reaching outside dir.
+func (h *fileHistory) path(room string) string {
+	return filepath.Join(h.dir, url.PathEscape(room)+historyExt)
+}
+
+func (h *fileHistory) Append(rec Record) (Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	file, err := os.OpenFile(h.path(rec.Room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return rec, err
+	}
+
+	h.lastID++
+	rec.ID = h.lastID
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		file.Close()
+		return rec, err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return rec, err
+}
+
+// Load returns the room's records that are still inside the retention window
+func (h *fileHistory) Load(room string) ([]Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, err := h.read(room)
+	return h.retain(room, records), err
+}
+
+func (h *fileHistory) Page(room string, before int64, n int) ([]Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	maxAge, maxMessages := h.retention(room)
+	cutoff := time.Now().Add(-maxAge)
+	var records []Record
+	seen := 0
+	err := h.readBackward(room, func(rec Record) bool {
+		seen++
+		if (maxMessages > 0 && seen > maxMessages) || (maxAge > 0 && rec.Time.Before(cutoff)) {
+			return false
+		}
+		if before > 0 && rec.ID >= before {
+			return true
+		}
+		records = append(records, rec)
+		return len(records) < n
+	})
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, err
+}
+
+// readChunk is how much of a file readBackward reads at a time
+const readChunk = 64 * 1024
+
+// readBackward hands the room's records to fn newest first, until fn
+// returns false or the file's start is reached
+func (h *fileHistory) readBackward(room string, fn func(Record) bool) error {
+	file, err := os.Open(h.path(room))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// partial is the start of a line whose beginning is further back
+	var partial []byte
+	for offset := info.Size(); offset > 0; {
+		size := int64(readChunk)
+		if size > offset {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size, size+int64(len(partial)))
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return err
+		}
+		chunk = append(chunk, partial...)
+		end := len(chunk)
+		for {
+			i := bytes.LastIndexByte(chunk[:end], '\n')
+			if i < 0 && offset > 0 {
+				break
+			}
+			line := chunk[i+1 : end]
+			end = i
+			if !h.decodeLine(room, line, fn) {
+				return nil
+			}
+			if i < 0 {
+				break
+			}
+		}
+		if end > 0 {
+			partial = append([]byte(nil), chunk[:end]...)
+		} else {
+			partial = nil
+		}
+	}
+	return nil
+}
+
+// decodeLine passes the record on line to fn, skipping blank and bad lines.
+// It returns what fn did, or true for a skipped line.
+func (h *fileHistory) decodeLine(room string, line []byte, fn func(Record) bool) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return true
+	}
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		warnf("Skipping bad record in %s: %v", h.path(room), err)
+		return true
+	}
+	return fn(rec)
+}
+
+func (h *fileHistory) read(room string) ([]Record, error) {
+	file, err := os.Open(h.path(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			warnf("Skipping bad record in %s: %v", h.path(room), err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// retain drops the records that fall outside the room's age and count limits
+func (h *fileHistory) retain(room string, records []Record) []Record {
+	maxAge, maxMessages := h.retention(room)
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		i := 0
+		for i < len(records) && records[i].Time.Before(cutoff) {
+			i++
+		}
+		records = records[i:]
+	}
+	if maxMessages > 0 && len(records) > maxMessages {
+		records = records[len(records)-maxMessages:]
+	}
+	return records
+}
+
+// prune rewrites every room file so it only holds what retention keeps. It
+// takes one room at a time, so the others can be written to meanwhile.
+func (h *fileHistory) prune() {
+	for _, room := range h.rooms() {
+		if maxAge, maxMessages := h.retention(room); maxAge != 0 || maxMessages != 0 {
+			h.pruneRoom(room)
+		}
+	}
+}
+
+func (h *fileHistory) pruneRoom(room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, err := h.read(room)
+	if err != nil {
+		errorf("Error reading chat log file: %v", err)
+		return
+	}
+	kept := h.retain(room, records)
+	if len(kept) == len(records) {
+		return
+	}
+	var b strings.Builder
+	for _, rec := range kept {
+		line, _ := json.Marshal(rec)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	tmp := h.path(room) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		errorf("Error pruning chat log file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.path(room)); err != nil {
+		errorf("Error pruning chat log file: %v", err)
+	}
+}
+
+// pruneInterval is how often a running server trims the room files down to
+// what retention keeps, which otherwise only happens on a start or reload
+const pruneInterval = time.Hour
+
+// pruneHistory trims the room files of the history store, if it keeps them
+// on disk
+func pruneHistory() {
+	if h, ok := history.(*fileHistory); ok {
+		h.prune()
+	}
+}
+
+// rooms lists the rooms that have a history file
+func (h *fileHistory) rooms() []string {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		errorf("%v", err)
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), historyExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(e.Name(), historyExt))
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// wipe deletes every room's history
+func (h *fileHistory) wipe() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, room := range h.rooms() {
+		if err := os.Remove(h.path(room)); err != nil {
+			errorf("%v", err)
+		}
+	}
+	h.lastID = 0
+}
+
+// Close has nothing to do, Append closes each file once it's written
+func (h *fileHistory) Close() error {
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryHistoryAppendAndLoad(t *testing.T) {
+	h := newMemoryHistory()
+	first, _ := h.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: "hi"})
+	h.Append(Record{Room: "dev", Sender: "bob", Kind: kindJoin})
+	second, _ := h.Append(Record{Room: "global", Sender: "bob", Kind: kindMessage, Body: "hey"})
+
+	if first.ID == 0 || second.ID <= first.ID {
+		t.Fatalf("ids not increasing: %d then %d", first.ID, second.ID)
+	}
+	if first.Time.IsZero() {
+		t.Fatal("Append didn't stamp the record")
+	}
+	records, _ := h.Load("global")
+	if len(records) != 2 || records[0].Body != "hi" || records[1].Body != "hey" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+func TestFileHistoryPersistsAndRetains(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newFileHistory(dir, keepFor(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	h.Append(Record{Room: "../escape", Sender: "alice", Kind: kindMessage, Body: "old", Time: old})
+	for _, body := range []string{"a", "b", "c"} {
+		h.Append(Record{Room: "../escape", Sender: "alice", Kind: kindMessage, Body: body})
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = newFileHistory(dir, keepFor(time.Hour, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	records, err := h.Load("../escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Body != "b" || records[1].Body != "c" {
+		t.Fatalf("retention kept %+v", records)
+	}
+	next, _ := h.Append(Record{Room: "other", Kind: kindJoin, Sender: "bob"})
+	if next.ID != 5 {
+		t.Fatalf("id after reopen = %d, want 5", next.ID)
+	}
+	if rooms := h.rooms(); len(rooms) != 2 {
+		t.Fatalf("rooms = %v", rooms)
+	}
+}
+
+func TestFileHistoryPrune(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newFileHistory(dir, keepFor(time.Hour, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Minute} {
+		h.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: age.String(), Time: time.Now().Add(-age)})
+	}
+	h.prune()
+	records, err := h.read("global")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Body != "1m0s" {
+		t.Errorf("pruning kept %+v", records)
+	}
+	// a running server prunes too, say after a reload tightened retention,
+	// and what's written after a prune has to stick
+	defer func(old HistoryStore) { history = old }(history)
+	history = h
+	h.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: "new"})
+	h.retention = keepFor(time.Hour, 1)
+	pruneHistory()
+	h.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: "newer"})
+	if records, _ = h.read("global"); len(records) != 2 || records[0].Body != "new" || records[1].Body != "newer" {
+		t.Errorf("pruning again kept %+v", records)
+	}
+
+	h.wipe()
+	if rooms := h.rooms(); len(rooms) != 0 {
+		t.Errorf("wipe left %v", rooms)
+	}
+}
+
+func TestFileHistoryClosesFiles(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open files:", err)
+	}
+	h, err := newFileHistory(t.TempDir(), keepFor(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for i := range 100 {
+		if _, err := h.Append(Record{Room: fmt.Sprintf("room-%d", i), Kind: kindJoin, Sender: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, _ := os.ReadDir("/proc/self/fd")
+	// a little slack for whatever else the test binary has open
+	if len(after) > len(fds)+5 {
+		t.Errorf("%d files open after writing to 100 rooms, %d before", len(after), len(fds))
+	}
+}
+
+func TestRender(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	got := render(Record{Room: "global", Sender: "alice", Time: at, Kind: kindMessage, Body: "hi"})
+	if got != "[2024-05-01 12:30:00][alice]:hi\n" {
+		t.Errorf("message rendered as %q", got)
+	}
+	got = render(Record{Room: "global", Sender: "alice", Kind: kindRename, Body: "al"})
+	if !strings.Contains(got, "[alice] is now going by [al]") {
+		t.Errorf("rename rendered as %q", got)
+	}
+}
+
+func TestPage(t *testing.T) {
+	var records []Record
+	for id := int64(1); id <= 10; id++ {
+		records = append(records, Record{ID: id * 2})
+	}
+	ids := func(rs []Record) (out []int64) {
+		for _, r := range rs {
+			out = append(out, r.ID)
+		}
+		return
+	}
+	if got := ids(page(records, 0, 3)); len(got) != 3 || got[0] != 16 || got[2] != 20 {
+		t.Errorf("newest page = %v", got)
+	}
+	if got := ids(page(records, 7, 3)); len(got) != 3 || got[0] != 2 || got[2] != 6 {
+		t.Errorf("page before 7 = %v", got)
+	}
+	if got := page(records, 2, 3); len(got) != 0 {
+		t.Errorf("page before the first record = %v", ids(got))
+	}
+}
+
+func TestFileHistoryPage(t *testing.T) {
+	h, err := newFileHistory(t.TempDir(), keepFor(time.Hour, 150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Append(Record{Room: "global", Kind: kindMessage, Body: "too old", Time: time.Now().Add(-2 * time.Hour)})
+	// long enough that the file spans several of readBackward's chunks
+	body := strings.Repeat("x", 1000)
+	for i := 0; i < 200; i++ {
+		h.Append(Record{Room: "global", Sender: "alice", Kind: kindMessage, Body: body})
+	}
+
+	records, err := h.Page("global", 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 20 || records[0].ID != 182 || records[19].ID != 201 {
+		t.Fatalf("newest page is %d records from %d", len(records), records[0].ID)
+	}
+	records, _ = h.Page("global", 100, 30)
+	if len(records) != 30 || records[0].ID != 70 || records[29].ID != 99 {
+		t.Fatalf("page before 100 is %d records from %d", len(records), records[0].ID)
+	}
+	// only the newest 150 are kept, the first of them is 52
+	records, _ = h.Page("global", 60, 30)
+	if len(records) != 8 || records[0].ID != 52 {
+		t.Fatalf("page past the retention limit is %d records", len(records))
+	}
+
+	h, err = newFileHistory(h.dir, keepFor(time.Hour, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.lastID != 201 {
+		t.Errorf("reopened history is at id %d", h.lastID)
+	}
+	if records, _ = h.Page("global", 3, 10); len(records) != 1 || records[0].ID != 2 {
+		t.Errorf("page past the age limit is %v", records)
+	}
+}
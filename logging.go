@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel says how important a line in the server log is
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// minLevel is the least important level that still gets printed, it can
+// change on a config reload while other goroutines are logging
+var minLevel atomic.Int32
+
+func init() {
+	setLogLevel(levelInfo)
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, use one of %s", s, strings.Join(levelNames, ", "))
+}
+
+func setLogLevel(level logLevel) {
+	minLevel.Store(int32(level))
+}
+
+func logAt(level logLevel, format string, args ...any) {
+	if int32(level) < minLevel.Load() {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func debugf(format string, args ...any) { logAt(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logAt(levelError, format, args...) }
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net-cat/basic"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -27,358 +31,561 @@ var (
 	White       = "\033[97m"
 )
 
-var (
-	groupChats  = make(map[string][]int)
-	clientMutex sync.Mutex
-)
+// disableColors blanks out the colors for terminals that can't show them
+func disableColors() {
+	for _, color := range []*string{&Reset, &Red, &Green, &Yellow, &BoldYellow, &Blue, &Magenta, &BoldMagenta, &Cyan, &Gray, &White} {
+		*color = ""
+	}
+}
 
 func main() {
-	deleteChatFiles()
-	clearChat()
 	port := getPort()
-	done := make(chan bool)
-	go startServer(port)
-	<-done
+	if *genCert != "" {
+		makeCert(*genCert)
+		return
+	}
+	openConfig(port)
+	openHistory()
+	openTopics()
+	openAccounts()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := reloadConfig(); err != nil {
+				errorf("Error reloading the config, keeping the old one: %v", err)
+			}
+		}
+	}()
+	go func() {
+		for range time.Tick(pruneInterval) {
+			pruneHistory()
+		}
+	}()
+
+	listeners := startServers()
+	sig := <-stop
+	infof("Received %v, shutting down", sig)
+	shutdown(listeners)
 }
 
+// getPort returns the port of `./TCPChat $port`, or "" if it wasn't given
 func getPort() string {
-	var port string
-	switch len(os.Args) {
+	flag.Parse()
+	switch flag.NArg() {
+	case 0:
+		return ""
 	case 1:
-		port = "8989"
-	case 2:
-		port = os.Args[1]
+		return flag.Arg(0)
 	default:
-		fmt.Println("[USAGE]: ./TCPChat $port")
+		fmt.Println("[USAGE]: ./TCPChat [flags] $port")
 		os.Exit(1)
 	}
-	return port
+	return ""
 }
 
-func startServer(port string) {
-	listener, err := net.Listen("tcp", ":"+port)
-	errorCheck(fmt.Sprintf("Error starting server on port %s: ", port), err)
-	defer listener.Close()
+// startServers starts the plain and the TLS listener, whichever are
+// configured, and returns them so they can be closed on shutdown
+func startServers() []net.Listener {
+	cfg := config()
+	var listeners []net.Listener
+	if cfg.Listen != "" {
+		listeners = append(listeners, startServer(cfg.Listen, nil))
+	}
+	if cfg.TLS.Listen != "" {
+		tlsConfig, err := cfg.TLS.serverConfig()
+		errorCheck("Error loading the TLS certificate:", err)
+		listeners = append(listeners, startServer(cfg.TLS.Listen, tlsConfig))
+	}
+	return listeners
+}
 
-	fmt.Printf("Server listening on port %s...\n", port)
+// startServer starts accepting clients on addr, over TLS if tlsConfig
+// isn't nil
+func startServer(addr string, tlsConfig *tls.Config) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	errorCheck(fmt.Sprintf("Error starting server on %s: ", addr), err)
 
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		fmt.Printf("Server listening on %s with TLS...\n", listener.Addr())
+	} else {
+		fmt.Printf("Server listening on %s...\n", listener.Addr())
+	}
+
+	go acceptClients(listener)
+	return listener
+}
+
+func acceptClients(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Println("Error accepting connection:", err)
+			errorf("Error accepting connection: %v", err)
+			continue
+		}
+		if limit := config().MaxClients; limit > 0 && sessions.count() >= limit {
+			warnf("Turning away %s, the server is full", conn.RemoteAddr())
+			// on a TLS connection the Write runs the handshake first, which
+			// can take up to handshakeTimeout, so it's done off the accept loop
+			go func() {
+				conn.SetDeadline(time.Now().Add(handshakeTimeout))
+				conn.Write([]byte(Red + "The server is full, try again later\n" + Reset))
+				conn.Close()
+			}()
 			continue
 		}
-		go handleNewClient(conn)
+		connections.Add(1)
+		// registered right here so the next Accept sees it in the count
+		handleNewClient(conn)
 	}
 }
 
 func handleNewClient(conn net.Conn) {
-	conn.Write([]byte(BoldYellow + "\nTo add/join a group chat:\n" + Reset + ":chat: <name of group chat>\n"))
-	conn.Write([]byte(BoldYellow + "To change your name:\n" + Reset + ":name: <new name>\n"))
-	conn.Write([]byte(BoldYellow + "To exit the current group chat:\n" + Reset + ":exit:\n"))
-	conn.Write([]byte(BoldMagenta + "By default, you'll be added to the global chat unless it's full.\n\n" + Reset))
-	go handleConnection(conn)
+	c := sessions.register(conn)
+	c.send("\n" + helpText())
+	cfg := config()
+	if cfg.MOTD != "" {
+		c.send(BoldMagenta + cfg.MOTD + "\n" + Reset)
+	}
+	c.send(BoldMagenta + "By default, you'll be added to the " + cfg.DefaultRoom + " chat unless it's full.\n\n" + Reset)
+	go handleConnection(c)
 }
 
-func removeClient(conn net.Conn, currentGroup string) {
+func removeClient(c *client, currentGroup string) {
 	if currentGroup != "" {
-		clientMutex.Lock()
-		name := getClientByConn(conn).name
-		for i, clientId := range groupChats[currentGroup] {
-			c := getClientById(clientId)
-			if c.conn == conn {
-				groupChats[currentGroup][i], groupChats[currentGroup][len(groupChats[currentGroup])-1] = groupChats[currentGroup][len(groupChats[currentGroup])-1], groupChats[currentGroup][i]
-				groupChats[currentGroup] = groupChats[currentGroup][:len(groupChats[currentGroup])-1]
-				break
-			}
+		r := findRoom(currentGroup)
+		if r != nil {
+			r.leave(c.id)
 		}
-		clientMutex.Unlock()
-		leaveMsg := fmt.Sprintf("%s has left our chat...\n", name)
-		broadcastMessage(currentGroup, conn, Yellow+leaveMsg+Reset)
-		if currentGroupName(conn) == "" {
-			c := getClientByConn(conn)
-			c.conn.Close()
-			*c = client{}
-			log.Printf("Client %s disconnected", name)
+		c.forget(currentGroup)
+		publish(Record{Room: currentGroup, Sender: c.Name(), Kind: kindLeave})
+		// only now, so whoever takes the spot sees the leave once, in the replay
+		if r != nil {
+			r.admitWaiting()
 		}
+		if c.lastGroup() == "" {
+			sessions.remove(c.id)
+			infof("Client %s disconnected", c.Name())
+		}
+	}
+}
+
+// disconnectClient drops c from every group it's still in and ends its session
+func disconnectClient(c *client) {
+	for _, r := range allRooms() {
+		r.cancelWait(c.id)
+	}
+	for groupName := c.lastGroup(); groupName != ""; groupName = c.lastGroup() {
+		removeClient(c, groupName)
 	}
+	sessions.remove(c.id)
 }
 
-func getName(conn net.Conn) string {
-	conn.Write([]byte("[ENTER YOUR NAME]: "))
-	reader := bufio.NewReader(conn)
+// getName asks the client for a name until it picks a free one and claims it
+func getName(c *client) error {
+	c.send("[ENTER YOUR NAME]: ")
 	for {
-		name, err := reader.ReadString('\n')
+		name, err := c.reader.ReadString('\n')
 		if err != nil {
-			errorCheck("Error reading the name:", err)
-			conn.Write([]byte("[ENTER YOUR NAME]: "))
-			continue
+			return err
 		}
 		name = strings.TrimSpace(name)
-		if isDuplicateName(name) {
-			conn.Write([]byte(Red + "NAME IS TAKEN\n" + Reset))
-			conn.Write([]byte("[ENTER ANOTHER NAME]: "))
+		if name == "" {
+			c.send("[ENTER YOUR NAME]: ")
 			continue
 		}
-		if name != "" {
-			return name
+		if token, ok := resumeToken(name); ok {
+			if err := resumeSession(c, token); err != nil {
+				c.send(Red + err.Error() + "\n" + Reset)
+				c.send("[ENTER YOUR NAME]: ")
+				continue
+			}
+			return errResumed
+		}
+		err = validateName(name)
+		if registered, ok := users.registered(name); err == nil && ok && !c.mayUse(registered) {
+			name = registered
+			err = askPassword(c, name)
+			if err == errTooManyFailures {
+				return err
+			}
+		}
+		if err == nil {
+			err = sessions.rename(c, name)
+		}
+		if err != nil {
+			c.send(Red + err.Error() + "\n" + Reset)
+			c.send("[ENTER ANOTHER NAME]: ")
+			continue
 		}
-		conn.Write([]byte("[ENTER YOUR NAME]: "))
+		offerResume(c)
+		return nil
 	}
 }
 
-// checks if chat is full, and creates it if it doesn't exist
-func checkGroupChat(groupName string, conn net.Conn) error {
-	_, ok := groupChats[groupName]
-	if !ok {
-		groupChats[groupName] = []int{}
-	} else if c := getClientByConn(conn); c != nil && groupName == c.currActiveGroup {
-		conn.Write([]byte("YOU'RE ALREADY IN " + groupName + "\n"))
-		return errors.New("client already in group")
-	} else if len(groupChats[groupName]) == 10 {
-		conn.Write([]byte(BoldMagenta + "Oops, " + groupName + " chat is packed right now! Try again in a bit " + Reset + ":)\n"))
-		return errors.New("group is full")
-	}
-	return nil
+func writeRoomFull(groupName string, c *client) {
+	c.send(BoldMagenta + "Oops, " + groupName + " chat is packed right now! Try again in a bit " + Reset + ":)\n")
+	c.send(Gray + "or type :wait: " + groupName + " to get in line for it\n" + Reset)
 }
 
-func isClientInGroup(groupName string, clientId int) bool {
-	for _, id := range groupChats[groupName] {
-		if id == clientId {
-			return true
+// joinChat adds c to the new group, and if it's the first time joining a group
+// it asks for the client's name
+func joinChat(groupName string, c *client) {
+	if c.activeGroup() == groupName {
+		c.send("YOU'RE ALREADY IN " + groupName + "\n")
+		return
+	}
+	if c.isIn(groupName) {
+		switchChat(groupName, c)
+		return
+	}
+	r := getRoom(groupName)
+	members, settings := r.info()
+	if len(members) >= settings.MaxMembers {
+		writeRoomFull(groupName, c)
+		// a name is needed to wait in line, so ask for it now
+		if c.Name() == "" {
+			if err := getName(c); err != nil && err != errResumed {
+				errorf("Error reading the name: %v", err)
+			}
 		}
+		return
 	}
-	return false
-}
 
-// returns bool value whether it has added client to group or not
-func addClientToGroup(groupName string, clientId int) bool {
-	// check if client id is already in the group
+	c.send("Welcome to " + groupName + " Chat!\n")
+	writeLogo(groupName, settings, c)
 
-	// if the client is already in group
-	if isClientInGroup(groupName, clientId) {
-		return false
+	if c.Name() == "" {
+		if err := getName(c); err == errResumed {
+			return
+		} else if err != nil {
+			errorf("Error reading the name: %v", err)
+			return
+		}
 	}
 
-	groupChats[groupName] = append(groupChats[groupName], clientId)
-	return true
-}
-
-// addChat adds conn to the new group, and if it's the first time joining a group
-// it registers the conn in the clientsArr
-func joinChat(groupName string, conn net.Conn) {
-	var clientName string
-	if err := checkGroupChat(groupName, conn); err != nil {
+	if err := r.join(c.id); err == errRoomFull {
+		writeRoomFull(groupName, c)
+		return
+	} else if err == errAlreadyMember {
+		switchChat(groupName, c)
 		return
 	}
+	enterChat(groupName, settings, c)
+}
 
-	conn.Write([]byte("Welcome to " + groupName + " Chat!\n"))
-	writeLogo(groupName, conn)
+// enterChat focuses c on a group it has just been added to, catches it up
+// on the history and tells the others it's here
+func enterChat(groupName string, settings roomSettings, c *client) {
+	c.focus(groupName)
+	writeRoomIntro(settings, c)
+	loadChat(c, groupName)
+	publish(Record{Room: groupName, Sender: c.Name(), Kind: kindJoin})
+}
 
-	c := getClientByConn(conn)
-	if c == nil {
-		clientName = getName(conn)
-	} else {
-		clientName = c.name
+// admitChat brings in a client whose turn on the waitlist has come, the
+// room has already made it a member
+func admitChat(groupName string, c *client) {
+	r := findRoom(groupName)
+	if r == nil {
+		return
 	}
+	_, settings := r.info()
+	c.send(Green + "A spot opened up in " + groupName + "!\n" + Reset)
+	c.send("Welcome to " + groupName + " Chat!\n")
+	writeLogo(groupName, settings, c)
+	enterChat(groupName, settings, c)
+}
 
-	clientMutex.Lock()
-	id := registerClient(clientName, groupName, conn)
-	isAdded := addClientToGroup(groupName, id)
-	clientsArr[id].currActiveGroup = groupName
-	clientMutex.Unlock()
+// switchChat refocuses c on a group it has already joined and shows it what
+// it missed there
+func switchChat(groupName string, c *client) {
+	c.focus(groupName)
+	c.send(BoldYellow + "--- switched to " + groupName + " ---\n" + Reset)
+	if conv := c.takePending(groupName); conv != "" {
+		c.send(conv)
+	}
+}
 
-	joinMsg := fmt.Sprintf("%s has joined %s...\n", clientName, groupName)
-	broadcastMessage(groupName, conn, Magenta+joinMsg+Reset)
+// leaveChat takes c out of groupName without touching its other groups
+func leaveChat(groupName string, c *client) cmdResult {
+	if groupName == c.activeGroup() {
+		return exitClient(c)
+	}
+	removeClient(c, groupName)
+	c.send(Yellow + "You left " + groupName + "\n" + Reset)
+	return resultContinue
+}
 
-	c = getClientByConn(conn)
-	if isAdded {
-		loadChat(c.conn, groupName)
+// writeRoomIntro shows the room's welcome text and topic
+func writeRoomIntro(settings roomSettings, c *client) {
+	if settings.Welcome != "" {
+		c.send(BoldMagenta + settings.Welcome + "\n" + Reset)
 	}
-	if conv, ok := c.pendingConv[groupName]; ok {
-		conn.Write([]byte(conv))
-		delete(c.pendingConv, groupName)
+	if settings.Topic != "" {
+		c.send(Cyan + "Topic: " + Reset + settings.Topic + "\n")
 	}
 }
 
-func writeLogo(groupName string, conn net.Conn) {
-	if groupName != "global" {
-		conn.Write([]byte(basic.Basic(cap(groupName), "standard")))
+func writeLogo(groupName string, settings roomSettings, c *client) {
+	if !bannerSafe(groupName) {
+		// the banner fonts only have the printable ASCII characters
+		c.send(BoldMagenta + groupName + "\n" + Reset)
+	} else if settings.BannerFont != "" {
+		c.send(basic.Basic(cap(groupName), settings.BannerFont))
+	} else if groupName != config().DefaultRoom {
+		c.send(basic.Basic(cap(groupName), "standard"))
 	} else {
-		linuxlogo, err := os.ReadFile("linuxlogo.txt")
-		errorCheck("Error reading linux logo:", err)
-		conn.Write(linuxlogo)
+		logo, err := os.ReadFile(config().Logo)
+		errorCheck("Error reading the logo:", err)
+		c.send(string(logo))
 	}
 }
 
-func welcomeBackTo(groupName string, conn net.Conn) {
-	conn.Write([]byte("Welcome back to " + groupName + "\n"))
-	writeLogo(groupName, conn)
-	c := getClientByConn(conn)
-	if conv, ok := c.pendingConv[groupName]; ok {
-		conn.Write([]byte(conv))
-		delete(c.pendingConv, groupName)
+func bannerSafe(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] > 126 {
+			return false
+		}
 	}
+	return true
 }
 
-func currentGroupName(conn net.Conn) string {
-	for groupName, clients := range groupChats {
-		for _, clientId := range clients {
-			if getClientById(clientId).conn == conn {
-				return groupName
-			}
-		}
+func welcomeBackTo(groupName string, c *client) {
+	c.send("Welcome back to " + groupName + "\n")
+	if r := findRoom(groupName); r != nil {
+		_, settings := r.info()
+		writeLogo(groupName, settings, c)
+	}
+	if conv := c.takePending(groupName); conv != "" {
+		c.send(conv)
 	}
-	return ""
 }
 
-func exitClient(conn net.Conn) string {
-	cl := getClientByConn(conn)
-	groupName := cl.currActiveGroup
-	removeClient(conn, groupName)
-	cl.currActiveGroup = currentGroupName(conn)
-	if cl.currActiveGroup == "" {
-		return "EXIT"
+func exitClient(c *client) cmdResult {
+	removeClient(c, c.activeGroup())
+	next := c.lastGroup()
+	if next == "" {
+		return resultExit
 	} else {
-		welcomeBackTo(cl.currActiveGroup, conn)
-		return "CONTINUE"
+		c.focus(next)
+		welcomeBackTo(next, c)
+		return resultContinue
 	}
 }
 
-func processMessage(msg string, conn net.Conn) string {
-	cl := getClientByConn(conn)
+// searchChat sends c the messages matching query in its active group, or
+// in every group it's in when query starts with -all
+func searchChat(c *client, query string) {
+	rooms := []string{c.activeGroup()}
+	if rest, ok := strings.CutPrefix(query, "-all"); ok && (rest == "" || rest[0] == ' ') {
+		query = strings.TrimSpace(rest)
+		c.mu.Lock()
+		rooms = append([]string(nil), c.groups...)
+		c.mu.Unlock()
+	}
+	if len(searchTerms(query)) == 0 {
+		c.send(Red + "Usage: :search: [-all] <words to look for>\n" + Reset)
+		return
+	}
+	matches := searchIdx.search(query, rooms, searchLimit)
+	if len(matches) == 0 {
+		c.send(Gray + "No messages found for \"" + query + "\"\n" + Reset)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(Gray + "--- messages matching \"" + query + "\" ---\n" + Reset)
+	for _, rec := range matches {
+		b.WriteString(Cyan + "#" + rec.Room + " " + Reset + render(rec))
+	}
+	c.send(b.String())
+}
 
-	if cl != nil && len(msg) > 7 && msg[0:7] == ":name: " {
-		currAcGroup := cl.currActiveGroup
-		newName := msg[7:]
-		if newName == cl.name {
-			conn.Write([]byte(Green + "You're already using that name, aren't you" + Reset + " :)\n"))
-			return "CONTINUE"
+// renameClient announces cl's new name in every group it belongs to
+func renameClient(cl *client, oldName, newName string) {
+	cl.mu.Lock()
+	groups := append([]string(nil), cl.groups...)
+	cl.mu.Unlock()
+	for _, groupName := range groups {
+		if r := findRoom(groupName); r != nil {
+			rec := saveChat(Record{Room: groupName, Sender: oldName, Kind: kindRename, Body: newName})
+			r.rename(cl.id, render(rec))
 		}
-		if isDuplicateName(newName) {
-			conn.Write([]byte(Red + "NAME IS TAKEN\n" + Reset))
-			return "CONTINUE"
-		}
-		newNameMsg := "Heads up! [" + cl.name + "] is now going by [" + newName + "].\n"
-		saveChat(newNameMsg, currAcGroup)
-		broadcastMessage(currAcGroup, conn, Blue+newNameMsg+Reset)
-		conn.Write([]byte(Green + "You've successfully changed your name\n" + Reset))
-		cl.name = newName
-		return "CONTINUE"
-	}
-	if len(msg) > 7 && msg[0:7] == ":chat: " {
-		if len(msg) == 8 {
-			conn.Write([]byte(Red+"Invalid chat name, 1 character isn't descriptive enough.\n"+Reset))
-		} else {
-			joinChat(strings.TrimSpace(msg[7:]), conn)
-		}
-		return "CONTINUE"
 	}
-	if msg == ":exit:" {
-		return exitClient(conn)
+}
+
+// overLimit tells c to slow down if it's sending faster than the rate limit
+func overLimit(c *client) bool {
+	if c.allow(config().RateLimit) {
+		return false
 	}
-	if cl == nil {
-		return "CONTINUE"
+	c.send(Red + "You're sending messages too fast, slow down\n" + Reset)
+	return true
+}
+
+// filterMessage runs msg through its room's filters and says whether it's
+// still to be sent, telling c why if it isn't
+func filterMessage(c *client, msg *Message) bool {
+	if err := runFilters(msg); err != nil {
+		c.send(Red + "Your message wasn't sent: " + err.Error() + "\n" + Reset)
+		return false
 	}
-	return "Broadcast Message"
+	return msg.Body != ""
 }
 
-func handleConnection(conn net.Conn) {
-	joinChat("global", conn)
-	reader := bufio.NewReader(conn)
+func handleConnection(cl *client) {
+	defer connections.Done()
+	if err := handshake(cl); err != nil {
+		debugf("TLS handshake with client %d failed: %v", cl.id, err)
+		disconnectClient(cl)
+		return
+	}
+	if !certLogin(cl) {
+		joinChat(config().DefaultRoom, cl)
+	}
 	for {
-		cl := getClientByConn(conn)
-		message, err := reader.ReadString('\n')
+		message, err := cl.reader.ReadString('\n')
 		if err != nil {
-			log.Println("Connection closed:", err)
+			debugf("Connection closed: %v", err)
+			if !detachClient(cl) {
+				disconnectClient(cl)
+			}
 			return
 		}
+		cl.touch()
 		message = strings.TrimSpace(message)
-		if p := processMessage(message, conn); p == "CONTINUE" {
+		if result := processMessage(message, cl); result == resultContinue {
 			continue
-		} else if p == "EXIT" {
+		} else if result == resultExit {
 			break
 		}
-		formattedMessage := formatMessage(cl.name, message)
-		msg := fmt.Sprintf("Message in %s from %s: %s\n", cl.currActiveGroup, getClientByConn(conn).name, sanitize(message))
-		fmt.Print(msg)
-		saveChat(formattedMessage, cl.currActiveGroup)
-		broadcastMessage(cl.currActiveGroup, conn, formattedMessage)
+		message = sanitize(message)
+		if message == "" || overLimit(cl) {
+			continue
+		}
+		msg := &Message{Room: cl.activeGroup(), Sender: cl.Name(), Body: message, from: cl}
+		if !filterMessage(cl, msg) {
+			continue
+		}
+		fmt.Printf("Message in %s from %s: %s\n", msg.Room, msg.Sender, msg.Body)
+		publish(Record{Room: msg.Room, Sender: msg.Sender, Kind: kindMessage, Body: msg.Body, Notes: msg.Notes})
 	}
 }
 
-func formatMessage(name, message string) string {
-	if message == "" {
-		return ""
+// publish saves rec to its room's history and sends it to the room
+func publish(rec Record) {
+	broadcastMessage(rec.Room, render(saveChat(rec)))
+}
+
+func broadcastMessage(brGroupName string, message string) {
+	if r := findRoom(brGroupName); r != nil {
+		r.post(message)
 	}
-	message = sanitize(message)
-	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("[%s][%s]:%s\n", currentTime, name, message)
 }
 
-func broadcastMessage(brGroupName string, sender net.Conn, message string) {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
-	for _, clientId := range groupChats[brGroupName] {
-		c := getClientById(clientId)
-		if c == nil {
-			log.Fatal("SOMETHING IS WRONG\n", clientId)
-		}
-		if c.currActiveGroup == brGroupName {
-			_, err := c.conn.Write([]byte(message))
-			if err != nil {
-				log.Printf("Error sending message to %s: %v\n", c.name, err)
-			}
-		} else {
-			c.pendingConv[brGroupName] += message
+// saveChat stores rec in the history and returns it as stored
+func saveChat(rec Record) Record {
+	saved, err := history.Append(rec)
+	if err != nil {
+		errorf("Error writing to the chat history: %v", err)
+		if rec.Time.IsZero() {
+			rec.Time = time.Now()
 		}
-
+		return rec
 	}
+	searchIdx.add(saved)
+	return saved
+}
+
+// loadChat replays the newest records of chatName to a client that just joined it
+func loadChat(c *client, chatName string) {
+	showHistory(c, chatName, 0, config().Replay)
 }
 
-func saveChat(message, chatName string) {
-	file, err := os.OpenFile(chatName+".chat", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// showHistory sends c up to n records of chatName older than before (or
+// the newest n if before is 0), and remembers where it stopped so :more:
+// can page further back
+func showHistory(c *client, chatName string, before int64, n int) {
+	// one extra record tells whether there's anything left to page back to
+	records, err := history.Page(chatName, before, n+1)
 	if err != nil {
-		log.Println("Error opening chat log file:", err)
-		return
+		errorf("Error loading the chat: %v", err)
+	}
+	hasMore := len(records) > n
+	if hasMore {
+		records = records[1:]
+	}
+	var b strings.Builder
+	for _, rec := range records {
+		b.WriteString(render(rec))
+	}
+	if hasMore {
+		b.WriteString(Gray + "(:more: for older messages)\n" + Reset)
 	}
-	defer file.Close()
+	c.send(b.String())
 
-	_, err = file.WriteString(message)
-	if err != nil {
-		log.Println("Error writing message to chat log file:", err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pageSize = n
+	if hasMore {
+		c.historyFrom[chatName] = records[0].ID
+	} else {
+		// nothing older than this is left to show
+		c.historyFrom[chatName] = 1
 	}
 }
 
-func loadChat(client net.Conn, chatName string) {
-	chat, err := os.ReadFile(chatName + ".chat")
-	if err != nil {
-		log.Println("Error loading the chat", err)
+// moreHistory shows the page before the oldest record c has seen in its active group
+func moreHistory(c *client) {
+	groupName := c.activeGroup()
+	c.mu.Lock()
+	before, n := c.historyFrom[groupName], c.pageSize
+	c.mu.Unlock()
+	if before == 1 {
+		c.send(Gray + "No older messages in " + groupName + "\n" + Reset)
+		return
 	}
-	client.Write(chat)
+	c.send(Gray + "--- older messages in " + groupName + " ---\n" + Reset)
+	showHistory(c, groupName, before, n)
 }
 
 func clearChat() {
 	file, err := os.OpenFile("log.txt", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Println("Error clearing chat log file:", err)
+		errorf("Error clearing chat log file: %v", err)
 		return
 	}
 	file.Close()
 }
 
-func deleteChatFiles() {
-	entries, err := os.ReadDir("./")
-
-	if err != nil {
-		log.Println(err)
+// openHistory opens the history store, either wiping it like the server
+// used to on every start or trimming it down to the retention window
+func openHistory() {
+	store, err := newFileHistory(config().DataDir, func(room string) (time.Duration, int) {
+		return config().retention(room)
+	})
+	errorCheck("Error opening the chat history:", err)
+	if *wipeOnBoot {
+		store.wipe()
+		clearChat()
+	} else {
+		store.prune()
 	}
-	for _, e := range entries {
-		if !e.IsDir() && len(e.Name()) > 5 && e.Name()[len(e.Name())-5:] == ".chat" {
-			err := os.Remove(e.Name())
-			if err != nil {
-				log.Println(err)
-			}
+	history = store
+	for _, room := range store.rooms() {
+		records, err := store.Load(room)
+		if err != nil {
+			errorf("Error indexing the chat history: %v", err)
+		}
+		for _, rec := range records {
+			searchIdx.add(rec)
 		}
 	}
 }
@@ -391,16 +598,6 @@ func errorCheck(msg string, err error) {
 }
 
 func cap(s string) string {
-	return strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
-}
-
-func sanitize(msg string) string {
-	var s string
-
-	for _, char := range msg {
-		if (char >= 32 && char <= 126) || char == 'ö' || char == 'ä' || char == 'å' {
-			s += string(char)
-		}
-	}
-	return s
+	first, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(first)) + strings.ToLower(s[size:])
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// namePolicy is what a nickname has to look like
+type namePolicy struct {
+	MinLength int      `json:"min_length"`
+	MaxLength int      `json:"max_length"`
+	Reserved  []string `json:"reserved"`
+}
+
+func defaultNamePolicy() namePolicy {
+	return namePolicy{
+		MinLength: 2,
+		MaxLength: 20,
+		Reserved:  []string{"server", "admin", "root", "system", "moderator"},
+	}
+}
+
+var errNameTaken = errors.New("NAME IS TAKEN")
+
+// nameSymbols are what a name may have besides letters, marks and digits.
+// Spaces, brackets and colons would break "[time][name]:msg" and commands.
+const nameSymbols = "-_."
+
+// validateName checks name against the config's name policy, the error
+// says which rule it breaks. Whether it's taken is up to the session store.
+func validateName(name string) error {
+	policy := config().Names
+	length := utf8.RuneCountInString(name)
+	switch {
+	case length < policy.MinLength:
+		return fmt.Errorf("Names need at least %d characters", policy.MinLength)
+	case length > policy.MaxLength:
+		return fmt.Errorf("Names can be at most %d characters", policy.MaxLength)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) && !unicode.IsDigit(r) && !strings.ContainsRune(nameSymbols, r) {
+			return fmt.Errorf("Names can only have letters, numbers, dashes, underscores and dots, not %q", r)
+		}
+	}
+	if sanitize(name) != name {
+		return errors.New("That name has characters that aren't allowed here")
+	}
+	if !unicode.IsLetter([]rune(name)[0]) {
+		return errors.New("Names have to start with a letter")
+	}
+	key := nameKey(name)
+	for _, reserved := range policy.Reserved {
+		if key == nameKey(reserved) {
+			return fmt.Errorf("%q is reserved", reserved)
+		}
+	}
+	return nil
+}
+
+// confusables maps characters to the Latin ones they're easily mistaken
+// for, so "аlice" in Cyrillic and "a1ice" can't pass for "alice"
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'һ': 'h', 'ӏ': 'l',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ζ': 'z', 'μ': 'u',
+	// Latin look-alikes and digits
+	'ı': 'i', 'ɡ': 'g', 'ɑ': 'a', 'ℓ': 'l', '0': 'o', '1': 'l', '5': 's',
+}
+
+// nameKey is what names are compared by: case folded, with look-alike
+// characters replaced and "rn" read as the "m" it looks like
+func nameKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if plain, ok := confusables[r]; ok {
+			r = plain
+		}
+		b.WriteRune(r)
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"alice", "Jürgen", "bob_2", "ana.maria", "Zoë-Li", "Дмитрий"} {
+		if err := validateName(name); err != nil {
+			t.Errorf("validateName(%q) = %v", name, err)
+		}
+	}
+	bad := map[string]string{
+		"a":                     "at least",
+		strings.Repeat("x", 21): "at most",
+		"bob smith":             "only have",
+		"[bob]":                 "only have",
+		"bo\033[31mb":           "only have",
+		"2pac":                  "start with a letter",
+		"Admin":                 "reserved",
+		"SERVER":                "reserved",
+		"r00t":                  "reserved",
+	}
+	for name, want := range bad {
+		if err := validateName(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateName(%q) = %v, want it to say %q", name, err, want)
+		}
+	}
+}
+
+func TestRenameConfusables(t *testing.T) {
+	s := newSessionStore()
+	alice, bob := &client{}, &client{}
+	s.byID[1], s.byID[2] = alice, bob
+	if err := s.rename(alice, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rename(bob, "alice"); err != errNameTaken {
+		t.Errorf("same name: %v", err)
+	}
+	if err := s.rename(bob, "ALICE"); err != errNameTaken {
+		t.Errorf("same name in capitals: %v", err)
+	}
+	for _, lookalike := range []string{"аlice", "a1ice"} {
+		if err := s.rename(bob, lookalike); err == nil || err == errNameTaken {
+			t.Errorf("rename to %q: %v", lookalike, err)
+		}
+	}
+	if err := s.rename(alice, "Alice"); err != nil {
+		t.Errorf("changing the case of your own name: %v", err)
+	}
+	if s.lookupName("ALICE") != alice {
+		t.Error("lookup isn't case-insensitive")
+	}
+	if nameKey("modern") != nameKey("modem") {
+		t.Error("rn wasn't read as m")
+	}
+}
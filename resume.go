@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// resumePrefix is what a client enters instead of its name, followed by its
+// token, to resume a session that lost its connection
+const resumePrefix = ":resume:"
+
+var (
+	// errResumed tells joinChat the client took over an earlier session
+	// instead of picking a name
+	errResumed      = errors.New("session resumed")
+	errUnknownToken = errors.New("There's no session waiting for that token, it may have run out")
+)
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// offerResume gives c a token to resume its session with and tells it how
+func offerResume(c *client) {
+	grace := config().ResumeGrace
+	if grace <= 0 {
+		return
+	}
+	token, err := sessions.issueToken(c)
+	if err != nil {
+		warnf("Error making a resume token: %v", err)
+		return
+	}
+	c.send(Gray + "If you lose your connection, enter \"" + resumePrefix + " " + token + "\" as your name within " + grace.String() + " to pick up where you left off\n" + Reset)
+}
+
+// detachClient keeps the session of c, whose connection dropped, for the
+// resume grace period, after which it's disconnected. It reports false if
+// the session can't be kept: resuming is off, c never got into a group or
+// it was kicked.
+func detachClient(c *client) bool {
+	grace := time.Duration(config().ResumeGrace)
+	if grace <= 0 || c.lastGroup() == "" || !c.detach() {
+		return false
+	}
+	c.hangUp()
+	infof("%s lost their connection, keeping their session for %s", c.Name(), grace)
+	time.AfterFunc(grace, func() {
+		if c.expire() {
+			infof("%s didn't come back in time", c.Name())
+			disconnectClient(c)
+		}
+	})
+	return true
+}
+
+// resumeSession lets the nameless client c take over the detached session
+// the token was issued to
+func resumeSession(c *client, token string) error {
+	old := sessions.lookupToken(token)
+	if old == nil {
+		return errUnknownToken
+	}
+	return takeOver(c, old)
+}
+
+// takeOver moves the detached session old to the nameless client c
+func takeOver(c, old *client) error {
+	if !old.handOver(c) {
+		return errUnknownToken
+	}
+	for _, r := range allRooms() {
+		r.replaceMember(old.id, c.id)
+	}
+	sessions.replace(old, c)
+	infof("%s resumed their session", c.Name())
+
+	focus := c.activeGroup()
+	c.send(Green + "Welcome back, " + c.Name() + "! You're in " + focus + "\n" + Reset)
+	c.mu.Lock()
+	groups := append([]string(nil), c.groups...)
+	c.mu.Unlock()
+	for _, groupName := range groups {
+		if n := c.unread(groupName); n > 0 && groupName != focus {
+			c.send(Cyan + fmt.Sprintf("%d unread in %s\n", n, groupName) + Reset)
+		}
+	}
+	offerResume(c)
+	return nil
+}
+
+// resumeToken returns the token in a name prompt answer like
+// ":resume: <token>"
+func resumeToken(answer string) (string, bool) {
+	token, ok := strings.CutPrefix(answer, resumePrefix)
+	return strings.TrimSpace(token), ok
+}
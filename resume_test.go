@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestHandOver(t *testing.T) {
+	newClient := func() *client {
+		return &client{
+			out:         make(chan string, 10),
+			done:        make(chan struct{}),
+			pendingConv: make(map[string]string),
+			historyFrom: make(map[string]int64),
+		}
+	}
+	s := newSessionStore()
+	old, next := newClient(), newClient()
+	old.id, next.id = 1, 2
+	s.byID[1], s.byID[2] = old, next
+	if err := s.rename(old, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	old.focus("global")
+	old.focus("games")
+	token, err := s.issueToken(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if old.handOver(next) {
+		t.Fatal("handed over a session that's still connected")
+	}
+	if !old.detach() {
+		t.Fatal("couldn't detach")
+	}
+	old.deliver("games", "missed\n")
+	old.deliver("global", "unread\n")
+
+	if s.lookupToken(token) != old || !old.handOver(next) {
+		t.Fatal("couldn't hand over the detached session")
+	}
+	s.replace(old, next)
+	if next.Name() != "alice" || next.activeGroup() != "games" || !next.isIn("global") {
+		t.Errorf("resumed as %q in %q", next.Name(), next.activeGroup())
+	}
+	if got := <-next.out; got != "missed\n" {
+		t.Errorf("missed message %q", got)
+	}
+	if next.unread("global") != 1 {
+		t.Error("unread message wasn't kept")
+	}
+	old.deliver("games", "late\n")
+	if got := <-next.out; got != "late\n" {
+		t.Errorf("message sent to the old session: %q", got)
+	}
+	if s.lookupName("alice") != next || s.get(1) != nil || s.lookupToken(token) != nil {
+		t.Error("old session is still in the store")
+	}
+	if old.expire() {
+		t.Error("a resumed session expired")
+	}
+
+	kicked := newClient()
+	kicked.kick()
+	if kicked.detach() {
+		t.Error("a kicked client was detached")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRoomFull      = errors.New("group is full")
+	errAlreadyMember = errors.New("client already in group")
+	errNotMember     = errors.New("client not in group")
+	errNotFull       = errors.New("group has room")
+	errNotWaiting    = errors.New("client not waiting for group")
+)
+
+type roomOp int
+
+const (
+	opJoin roomOp = iota
+	opLeave
+	opPost
+	opRename
+	opList
+	opTopic
+	opAdmit
+	opWait
+	opCancelWait
+	opExpireWait
+	opReconfigure
+	opReplace
+)
+
+type roomCmd struct {
+	op       roomOp
+	clientId int
+	// newId is who takes clientId's place for opReplace
+	newId    int
+	text     string
+	settings roomSettings
+	reply    chan roomReply
+}
+
+type roomReply struct {
+	err      error
+	members  []int
+	settings roomSettings
+	position int
+}
+
+// waiter is a client in line for a full room
+type waiter struct {
+	clientId int
+	timer    *time.Timer
+}
+
+// room is a group chat. Its member list and settings are owned by the
+// room's own goroutine and only ever touched through the cmds channel, so
+// rooms never wait on each other and there is nothing to lock. Once the
+// last member is gone and nobody is waiting the goroutine stops and closes
+// gone, whoever comes next starts the room over.
+type room struct {
+	name     string
+	cmds     chan roomCmd
+	gone     chan struct{}
+	members  []int
+	waiting  []waiter
+	settings roomSettings
+}
+
+var (
+	rooms   = make(map[string]*room)
+	roomsMu sync.Mutex
+)
+
+// getRoom returns the room called name, starting it if it doesn't exist yet
+func getRoom(name string) *room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	r, ok := rooms[name]
+	if !ok {
+		r = &room{name: name, cmds: make(chan roomCmd), gone: make(chan struct{}), settings: config().settingsFor(name)}
+		rooms[name] = r
+		go r.run()
+	}
+	return r
+}
+
+// findRoom returns the room called name, or nil if nobody has created it
+func findRoom(name string) *room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	return rooms[name]
+}
+
+// allRooms returns a snapshot of every room that's running
+func allRooms() []*room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	list := make([]*room, 0, len(rooms))
+	for _, r := range rooms {
+		list = append(list, r)
+	}
+	return list
+}
+
+func (r *room) run() {
+	r.restoreTopic()
+	for cmd := range r.cmds {
+		var reply roomReply
+		switch cmd.op {
+		case opJoin:
+			reply.err = r.add(cmd.clientId)
+		case opLeave:
+			reply.err = r.remove(cmd.clientId)
+		case opAdmit:
+			r.admit()
+		case opPost:
+			r.deliver(cmd.text)
+		case opRename:
+			if r.isMember(cmd.clientId) {
+				r.deliver(cmd.text)
+			} else {
+				reply.err = errNotMember
+			}
+		case opList:
+			reply.members = append([]int(nil), r.members...)
+			reply.settings = r.settings
+		case opTopic:
+			r.settings.Topic = cmd.text
+		case opWait:
+			reply.position, reply.err = r.enqueue(cmd.clientId)
+		case opCancelWait:
+			reply.err = r.dequeue(cmd.clientId)
+		case opReconfigure:
+			// a topic set with :topic: stays unless the config's own changed
+			if cmd.settings.Topic == cmd.text {
+				cmd.settings.Topic = r.settings.Topic
+			}
+			r.settings = cmd.settings
+			// a bigger room lets the line in, a smaller one keeps who's there
+			r.admit()
+		case opReplace:
+			r.replace(cmd.clientId, cmd.newId)
+		case opExpireWait:
+			if r.dequeue(cmd.clientId) == nil {
+				if c := sessions.get(cmd.clientId); c != nil {
+					c.send(Yellow + "You've waited too long for " + r.name + ", you're out of the line\n" + Reset)
+				}
+			}
+		}
+		cmd.reply <- reply
+		if cmd.op != opList && len(r.members) == 0 && len(r.waiting) == 0 {
+			r.stop()
+			return
+		}
+	}
+}
+
+// stop takes the empty room out of the rooms map so it can't be found
+// anymore and lets the commands still on their way to it know it's gone
+func (r *room) stop() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if rooms[r.name] == r {
+		delete(rooms, r.name)
+	}
+	close(r.gone)
+	debugf("Room %s is empty, stopped it", r.name)
+}
+
+func (r *room) do(cmd roomCmd) roomReply {
+	cmd.reply = make(chan roomReply, 1)
+	select {
+	case r.cmds <- cmd:
+		return <-cmd.reply
+	case <-r.gone:
+	}
+	// the room stopped before it got the command. Joining or waiting starts
+	// it over, everything else would have found it empty anyway.
+	switch cmd.op {
+	case opJoin, opWait:
+		return getRoom(r.name).do(cmd)
+	case opList:
+		return roomReply{settings: config().settingsFor(r.name)}
+	case opLeave, opRename:
+		return roomReply{err: errNotMember}
+	case opCancelWait:
+		return roomReply{err: errNotWaiting}
+	}
+	return roomReply{}
+}
+
+func (r *room) join(clientId int) error {
+	return r.do(roomCmd{op: opJoin, clientId: clientId}).err
+}
+
+func (r *room) leave(clientId int) error {
+	return r.do(roomCmd{op: opLeave, clientId: clientId}).err
+}
+
+func (r *room) post(message string) {
+	r.do(roomCmd{op: opPost, text: message})
+}
+
+// rename announces a member's name change to the room
+func (r *room) rename(clientId int, notice string) error {
+	return r.do(roomCmd{op: opRename, clientId: clientId, text: notice}).err
+}
+
+func (r *room) list() []int {
+	return r.do(roomCmd{op: opList}).members
+}
+
+// info returns the members and the current settings of the room
+func (r *room) info() ([]int, roomSettings) {
+	reply := r.do(roomCmd{op: opList})
+	return reply.members, reply.settings
+}
+
+// wait puts clientId in line for the room and returns its place in it
+func (r *room) wait(clientId int) (int, error) {
+	reply := r.do(roomCmd{op: opWait, clientId: clientId})
+	return reply.position, reply.err
+}
+
+// admitWaiting fills any free spots from the front of the line
+func (r *room) admitWaiting() {
+	r.do(roomCmd{op: opAdmit})
+}
+
+func (r *room) cancelWait(clientId int) error {
+	return r.do(roomCmd{op: opCancelWait, clientId: clientId}).err
+}
+
+// reconfigure applies reloaded settings to the room. oldTopic is the topic
+// the config had before, so a topic set by hand survives the reload.
+func (r *room) reconfigure(settings roomSettings, oldTopic string) {
+	r.do(roomCmd{op: opReconfigure, settings: settings, text: oldTopic})
+}
+
+// replaceMember puts newId wherever clientId is, among the members or in line
+func (r *room) replaceMember(clientId, newId int) {
+	r.do(roomCmd{op: opReplace, clientId: clientId, newId: newId})
+}
+
+func (r *room) setTopic(topic string) {
+	r.do(roomCmd{op: opTopic, text: topic})
+}
+
+// restoreTopic picks up the last topic set with :topic:, from before a
+// restart or before the room last stopped
+func (r *room) restoreTopic() {
+	if topic, ok := topics.get(r.name); ok {
+		r.settings.Topic = topic
+	}
+}
+
+func (r *room) isMember(clientId int) bool {
+	for _, id := range r.members {
+		if id == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *room) add(clientId int) error {
+	if r.isMember(clientId) {
+		return errAlreadyMember
+	}
+	if len(r.members) >= r.settings.MaxMembers {
+		return errRoomFull
+	}
+	r.members = append(r.members, clientId)
+	return nil
+}
+
+func (r *room) enqueue(clientId int) (int, error) {
+	if r.isMember(clientId) {
+		return 0, errAlreadyMember
+	}
+	for i, w := range r.waiting {
+		if w.clientId == clientId {
+			return i + 1, nil
+		}
+	}
+	if len(r.members) < r.settings.MaxMembers {
+		return 0, errNotFull
+	}
+	r.waiting = append(r.waiting, r.newWaiter(clientId))
+	return len(r.waiting), nil
+}
+
+// newWaiter starts the clock on how long clientId may wait in line
+func (r *room) newWaiter(clientId int) waiter {
+	w := waiter{clientId: clientId}
+	if timeout := time.Duration(r.settings.WaitTimeout); timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			r.do(roomCmd{op: opExpireWait, clientId: clientId})
+		})
+	}
+	return w
+}
+
+func (r *room) dequeue(clientId int) error {
+	for i, w := range r.waiting {
+		if w.clientId == clientId {
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			r.notifyWaiting(i)
+			return nil
+		}
+	}
+	return errNotWaiting
+}
+
+// admit lets clients in from the front of the line while there's space
+func (r *room) admit() {
+	admitted := 0
+	for len(r.waiting) > 0 && len(r.members) < r.settings.MaxMembers {
+		w := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		c := sessions.get(w.clientId)
+		if c == nil || r.isMember(w.clientId) {
+			continue
+		}
+		r.members = append(r.members, w.clientId)
+		admitted++
+		// admitChat talks to this room, so it can't run on its goroutine
+		go admitChat(r.name, c)
+	}
+	if admitted > 0 {
+		r.notifyWaiting(0)
+	}
+}
+
+// notifyWaiting tells everyone from position from onwards where they now are
+func (r *room) notifyWaiting(from int) {
+	for i := from; i < len(r.waiting); i++ {
+		if c := sessions.get(r.waiting[i].clientId); c != nil {
+			c.send(Gray + fmt.Sprintf("You're now number %d in line for %s\n", i+1, r.name) + Reset)
+		}
+	}
+}
+
+func (r *room) remove(clientId int) error {
+	for i, id := range r.members {
+		if id == clientId {
+			r.members[i] = r.members[len(r.members)-1]
+			r.members = r.members[:len(r.members)-1]
+			return nil
+		}
+	}
+	return errNotMember
+}
+
+// replace swaps clientId for newId. A waiter's place in line stays, its
+// clock starts over.
+func (r *room) replace(clientId, newId int) {
+	for i, id := range r.members {
+		if id == clientId {
+			r.members[i] = newId
+		}
+	}
+	for i, w := range r.waiting {
+		if w.clientId == clientId {
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			r.waiting[i] = r.newWaiter(newId)
+		}
+	}
+}
+
+// deliver hands message to every member, live if they're focused on this
+// room and into their pendingConv otherwise
+func (r *room) deliver(message string) {
+	for _, id := range r.members {
+		if c := sessions.get(id); c != nil {
+			c.deliver(r.name, message)
+		}
+	}
+}
+
+func roomsCommand(c *client, args []string) cmdResult {
+	list := allRooms()
+	if len(list) == 0 {
+		c.send(Gray + "There are no group chats yet\n" + Reset)
+		return resultContinue
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	var b strings.Builder
+	b.WriteString(BoldYellow + "Group chats:\n" + Reset)
+	for _, r := range list {
+		members, settings := r.info()
+		fmt.Fprintf(&b, "  %-20s %2d/%d", r.name, len(members), settings.MaxMembers)
+		if c.isIn(r.name) {
+			if r.name == c.activeGroup() {
+				b.WriteString(Green + "  (you're here)" + Reset)
+			} else {
+				b.WriteString(Green + "  (joined)" + Reset)
+			}
+			if n := c.unread(r.name); n > 0 {
+				fmt.Fprintf(&b, Cyan+"  %d unread"+Reset, n)
+			}
+		}
+		if settings.Topic != "" {
+			b.WriteString(Gray + "  " + settings.Topic + Reset)
+		}
+		b.WriteString("\n")
+	}
+	c.send(b.String())
+	return resultContinue
+}
+
+// topicCommand shows the topic of the active group, or sets it
+func topicCommand(c *client, args []string) cmdResult {
+	groupName := c.activeGroup()
+	r := findRoom(groupName)
+	if r == nil {
+		return resultContinue
+	}
+	if len(args) == 0 {
+		if _, settings := r.info(); settings.Topic != "" {
+			c.send(Cyan + "Topic of " + groupName + ": " + Reset + settings.Topic + "\n")
+		} else {
+			c.send(Gray + groupName + " has no topic, set one with :topic: <topic>\n" + Reset)
+		}
+		return resultContinue
+	}
+	topic := sanitize(args[0])
+	r.setTopic(topic)
+	if err := topics.set(groupName, topic); err != nil {
+		errorf("Error saving the topic of %s: %v", groupName, err)
+	}
+	publish(Record{Room: groupName, Sender: c.Name(), Kind: kindTopic, Body: topic})
+	return resultContinue
+}
+
+func whoCommand(c *client, args []string) cmdResult {
+	groupName := c.activeGroup()
+	r := findRoom(groupName)
+	if r == nil {
+		return resultContinue
+	}
+	var b strings.Builder
+	b.WriteString(BoldYellow + "In " + groupName + ":\n" + Reset)
+	for _, id := range r.list() {
+		m := sessions.get(id)
+		if m == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "  %-20s idle %-8s", m.Name(), m.idle().Round(time.Second))
+		if focused := m.activeGroup(); focused != groupName {
+			b.WriteString(Gray + "  (in " + focused + ")" + Reset)
+		}
+		b.WriteString("\n")
+	}
+	c.send(b.String())
+	return resultContinue
+}
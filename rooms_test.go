@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomStopsWhenEmpty(t *testing.T) {
+	r := getRoom("test-empty")
+	if err := r.join(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.join(2); err != nil {
+		t.Fatal(err)
+	}
+	r.leave(1)
+	if findRoom("test-empty") != r {
+		t.Fatal("room stopped with a member left")
+	}
+	r.leave(2)
+	select {
+	case <-r.gone:
+	case <-time.After(time.Second):
+		t.Fatal("empty room didn't stop")
+	}
+	if findRoom("test-empty") != nil {
+		t.Error("stopped room can still be found")
+	}
+	if err := r.leave(2); err != errNotMember {
+		t.Errorf("leaving a stopped room: %v", err)
+	}
+
+	// a join that got hold of the room before it stopped starts a new one
+	if err := r.join(3); err != nil {
+		t.Fatal(err)
+	}
+	next := findRoom("test-empty")
+	if next == nil || next == r {
+		t.Fatal("joining a stopped room didn't start it over")
+	}
+	if members := next.list(); len(members) != 1 || members[0] != 3 {
+		t.Errorf("new room has %v", members)
+	}
+	next.leave(3)
+}
+
+func TestRoomMembersAndLine(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Rooms["test-small"] = roomSettings{MaxMembers: 1}
+	old := config()
+	liveConfig.Store(cfg)
+	defer liveConfig.Store(old)
+
+	r := getRoom("test-small")
+	if findRoom("test-small") != r || getRoom("test-small") != r {
+		t.Fatal("room was started twice")
+	}
+	if _, err := r.wait(1); err != errNotFull {
+		t.Errorf("waiting for a room with space: %v", err)
+	}
+	// nobody's in it yet, so that stopped it again
+	r = getRoom("test-small")
+	if err := r.join(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.join(1); err != errAlreadyMember {
+		t.Errorf("joining twice: %v", err)
+	}
+	if err := r.join(2); err != errRoomFull {
+		t.Errorf("joining a full room: %v", err)
+	}
+	if err := r.rename(2, "renamed\n"); err != errNotMember {
+		t.Errorf("renaming without being in: %v", err)
+	}
+	for want, id := range []int{2, 3} {
+		if position, err := r.wait(id); err != nil || position != want+1 {
+			t.Errorf("client %d is number %d in line: %v", id, position, err)
+		}
+	}
+	if position, _ := r.wait(2); position != 1 {
+		t.Errorf("waiting again moved client 2 to %d", position)
+	}
+	if err := r.cancelWait(2); err != nil {
+		t.Error(err)
+	}
+	if err := r.cancelWait(2); err != errNotWaiting {
+		t.Errorf("cancelling twice: %v", err)
+	}
+	members, settings := r.info()
+	if len(members) != 1 || members[0] != 1 || settings.MaxMembers != 1 {
+		t.Errorf("room has %v with %d spots", members, settings.MaxMembers)
+	}
+	if err := r.leave(2); err != errNotMember {
+		t.Errorf("leaving without being in: %v", err)
+	}
+	r.cancelWait(3)
+	r.leave(1)
+	select {
+	case <-r.gone:
+	case <-time.After(time.Second):
+		t.Error("room didn't stop")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// charPolicy narrows down which characters sanitize keeps. With an allow
+// list only the characters in one of its classes are kept, besides the
+// printable ASCII the server has always taken, and the deny list takes
+// characters out again. Classes are Unicode categories like "L" or "So"
+// and scripts like "Latin" or "Cyrillic".
+type charPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	allow, deny []*unicode.RangeTable
+}
+
+// compile looks up the policy's classes, it has to be called before keeps
+func (p *charPolicy) compile() error {
+	var err error
+	if p.allow, err = charClasses(p.Allow); err != nil {
+		return err
+	}
+	p.deny, err = charClasses(p.Deny)
+	return err
+}
+
+func charClasses(names []string) ([]*unicode.RangeTable, error) {
+	var tables []*unicode.RangeTable
+	for _, name := range names {
+		table, ok := unicode.Categories[name]
+		if !ok {
+			table, ok = unicode.Scripts[name]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown character class %q", name)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (p *charPolicy) keeps(r rune) bool {
+	if unicode.In(r, p.deny...) {
+		return false
+	}
+	return len(p.allow) == 0 || (r >= 32 && r <= 126) || unicode.In(r, p.allow...)
+}
+
+// isBidiControl reports the invisible characters that flip the direction of
+// the text around them, which can make a message read differently than it is
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069') || r == '\u200e' || r == '\u200f'
+}
+
+// sanitize strips what could mess with other people's terminals, escape
+// sequences and control characters, and whatever the config's character
+// policy doesn't allow. Letters, marks, numbers, punctuation and symbols of
+// any script are kept otherwise.
+func sanitize(msg string) string {
+	policy := &config().Chars
+	var b strings.Builder
+	b.Grow(len(msg))
+	for i := 0; i < len(msg); {
+		if n := escapeLen(msg[i:]); n > 0 {
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(msg[i:])
+		i += size
+		switch {
+		case r == '\t' || unicode.Is(unicode.Zs, r):
+			b.WriteByte(' ')
+		case r == unicode.ReplacementChar && size == 1:
+			// not UTF-8, drop the byte
+		case unicode.IsControl(r), isBidiControl(r), unicode.Is(unicode.Zl, r), unicode.Is(unicode.Zp, r):
+		case policy.keeps(r):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeLen returns how long the terminal escape sequence s starts with is,
+// 0 if it doesn't start with one. It knows CSI sequences like the colors
+// ("\033[31m"), OSC sequences like window titles and two byte escapes.
+func escapeLen(s string) int {
+	switch {
+	case strings.HasPrefix(s, "\033["), strings.HasPrefix(s, "\u009b"):
+		// both introducers are two bytes, then come parameters and
+		// intermediates and one final byte
+		i := 2
+		for i < len(s) && s[i] >= 0x20 && s[i] <= 0x3f {
+			i++
+		}
+		if i < len(s) && s[i] >= 0x40 && s[i] <= 0x7e {
+			i++
+		}
+		return i
+	case strings.HasPrefix(s, "\033]"):
+		// runs until BEL or ESC \
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == '\033' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	case s[0] == '\033':
+		if len(s) > 1 && s[1] >= 0x20 && s[1] <= 0x7e {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"hello", "hello"},
+		{"Grüße, Jürgen! Привет 你好 👋🏽", "Grüße, Jürgen! Привет 你好 👋🏽"},
+		{"é combining", "é combining"},
+		{"\033[31mred\033[0m text", "red text"},
+		{"\033]0;pwned\a title", " title"},
+		{"\033]8;;http://x\033\\link", "link"},
+		{"bell\a and\r back\bspace", "bell and backspace"},
+		{"\u009b2Jclear", "clear"},
+		{"tab\there", "tab here"},
+		{"evil\u202egnp.exe", "evilgnp.exe"},
+		{"bad \xff byte", "bad  byte"},
+	}
+	for _, tt := range tests {
+		if got := sanitize(tt.in); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizePolicy(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Chars = charPolicy{Allow: []string{"Latin"}, Deny: []string{"So"}}
+	if err := cfg.Chars.compile(); err != nil {
+		t.Fatal(err)
+	}
+	old := config()
+	liveConfig.Store(cfg)
+	defer liveConfig.Store(old)
+
+	if got := sanitize("Grüße 1, Привет ☺!"); got != "Grüße 1,  !" {
+		t.Errorf("sanitize with a policy = %q", got)
+	}
+	bad := charPolicy{Allow: []string{"Klingon"}}
+	if bad.compile() == nil {
+		t.Error("unknown class wasn't reported")
+	}
+}
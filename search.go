@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const searchLimit = 20
+
+// searchIndex is an inverted index from lowercased words to the messages
+// containing them. It's built from the history at startup and kept up to
+// date by saveChat. It drops what the retention of a room says is gone, for
+// which it keeps track of all of a room's records, not only the messages.
+type searchIndex struct {
+	mu        sync.Mutex
+	retention retentionFunc
+	postings  map[string]map[int64]struct{}
+	records   map[int64]Record
+	byRoom    map[string][]indexedRecord
+}
+
+// indexedRecord is what retention needs to know of a record, oldest first
+// per room
+type indexedRecord struct {
+	id   int64
+	time time.Time
+}
+
+var searchIdx = newSearchIndex(func(room string) (time.Duration, int) {
+	return config().retention(room)
+})
+
+func newSearchIndex(retention retentionFunc) *searchIndex {
+	return &searchIndex{
+		retention: retention,
+		postings:  make(map[string]map[int64]struct{}),
+		records:   make(map[int64]Record),
+		byRoom:    make(map[string][]indexedRecord),
+	}
+}
+
+// searchTerms splits text into the lowercased words the index is keyed by
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// add indexes rec if it's a chat message
+func (idx *searchIndex) add(rec Record) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.byRoom[rec.Room] = append(idx.byRoom[rec.Room], indexedRecord{rec.ID, rec.Time})
+	if rec.Kind == kindMessage {
+		idx.records[rec.ID] = rec
+		for _, term := range searchTerms(rec.Body) {
+			ids, ok := idx.postings[term]
+			if !ok {
+				ids = make(map[int64]struct{})
+				idx.postings[term] = ids
+			}
+			ids[rec.ID] = struct{}{}
+		}
+	}
+	idx.retain(rec.Room)
+}
+
+// search returns the newest messages, at most limit of them and oldest
+// first, that are in one of rooms and contain every word of query
+func (idx *searchIndex) search(query string, rooms []string, limit int) []Record {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	inRooms := make(map[string]bool)
+	for _, room := range rooms {
+		inRooms[room] = true
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for room := range inRooms {
+		idx.retain(room)
+	}
+	// walk the rarest term's postings and check the others against them
+	sort.Slice(terms, func(i, j int) bool { return len(idx.postings[terms[i]]) < len(idx.postings[terms[j]]) })
+	var matches []Record
+	for id := range idx.postings[terms[0]] {
+		rec := idx.records[id]
+		if !inRooms[rec.Room] {
+			continue
+		}
+		found := true
+		for _, term := range terms[1:] {
+			if _, ok := idx.postings[term][id]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			matches = append(matches, rec)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	return matches
+}
+
+// retain forgets the oldest records of room for as long as they're outside
+// its retention window, the same ones the history leaves out
+func (idx *searchIndex) retain(room string) {
+	maxAge, maxMessages := idx.retention(room)
+	cutoff := time.Now().Add(-maxAge)
+	kept := idx.byRoom[room]
+	for len(kept) > 0 && ((maxMessages > 0 && len(kept) > maxMessages) || (maxAge > 0 && kept[0].time.Before(cutoff))) {
+		if rec, ok := idx.records[kept[0].id]; ok {
+			delete(idx.records, rec.ID)
+			for _, term := range searchTerms(rec.Body) {
+				delete(idx.postings[term], rec.ID)
+				if len(idx.postings[term]) == 0 {
+					delete(idx.postings, term)
+				}
+			}
+		}
+		kept = kept[1:]
+	}
+	if len(kept) == 0 {
+		delete(idx.byRoom, room)
+	} else {
+		idx.byRoom[room] = kept
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex(keepFor(0, 0))
+	idx.add(Record{ID: 1, Room: "global", Sender: "alice", Kind: kindMessage, Body: "Deploy is DONE!"})
+	idx.add(Record{ID: 2, Room: "dev", Sender: "bob", Kind: kindMessage, Body: "deploy failed, rolling back"})
+	idx.add(Record{ID: 3, Room: "global", Sender: "bob", Kind: kindMessage, Body: "deploy again?"})
+	idx.add(Record{ID: 4, Room: "global", Sender: "deploy", Kind: kindJoin})
+
+	got := idx.search("deploy", []string{"global"}, 10)
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 3 {
+		t.Errorf("room search = %+v", got)
+	}
+	got = idx.search("done deploy", []string{"global", "dev"}, 10)
+	if len(got) != 1 || got[0].ID != 1 {
+		t.Errorf("all-terms search = %+v", got)
+	}
+	got = idx.search("deploy", []string{"global", "dev"}, 2)
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 3 {
+		t.Errorf("limited search = %+v", got)
+	}
+	if got := idx.search("!!", []string{"global"}, 10); got != nil {
+		t.Errorf("empty query matched %+v", got)
+	}
+}
+
+func TestSearchIndexRetention(t *testing.T) {
+	idx := newSearchIndex(func(room string) (time.Duration, int) {
+		if room == "short" {
+			return 0, 2
+		}
+		return time.Hour, 0
+	})
+	now := time.Now()
+	idx.add(Record{ID: 1, Room: "old", Kind: kindMessage, Body: "ancient deploy", Time: now.Add(-2 * time.Hour)})
+	idx.add(Record{ID: 2, Room: "old", Kind: kindMessage, Body: "recent deploy", Time: now})
+	idx.add(Record{ID: 3, Room: "short", Kind: kindMessage, Body: "first deploy", Time: now})
+	idx.add(Record{ID: 4, Room: "short", Kind: kindJoin, Sender: "bob", Time: now})
+	idx.add(Record{ID: 5, Room: "short", Kind: kindMessage, Body: "second deploy", Time: now})
+
+	got := idx.search("deploy", []string{"old", "short"}, 10)
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 5 {
+		t.Errorf("search past retention = %+v", got)
+	}
+	if _, ok := idx.postings["ancient"]; ok {
+		t.Error("expired message is still indexed")
+	}
+	if len(idx.records) != 2 {
+		t.Errorf("index holds %d messages", len(idx.records))
+	}
+}
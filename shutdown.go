@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// connections counts the handleConnection goroutines still running
+	connections sync.WaitGroup
+)
+
+const shutdownNotice = "\nThe server is shutting down. See you soon!\n"
+
+// shutdown stops accepting clients, tells everyone the server is going
+// away, waits for their connections to drain and closes the chat history
+func shutdown(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	// posting reaches each member live in the room it's focused on, so
+	// nobody gets the notice twice
+	for _, r := range allRooms() {
+		r.post(BoldYellow + shutdownNotice + Reset)
+	}
+	for _, c := range sessions.all() {
+		if c.activeGroup() == "" {
+			c.send(BoldYellow + shutdownNotice + Reset)
+		}
+		c.kick()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		infof("All clients disconnected")
+	case <-time.After(time.Duration(config().ShutdownTimeout)):
+		warnf("Timed out waiting for clients to disconnect")
+	}
+
+	if err := history.Close(); err != nil {
+		errorf("Error closing the chat history: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsClients(t *testing.T) {
+	old := history
+	history = newMemoryHistory()
+	defer func() { history = old }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptClients(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// wait for the name prompt, by then the client has its session
+	buf := make([]byte, 4096)
+	var greeting strings.Builder
+	for !strings.Contains(greeting.String(), "[ENTER YOUR NAME]") {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		greeting.Write(buf[:n])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdown([]net.Listener{listener})
+		close(done)
+	}()
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rest), strings.TrimSpace(shutdownNotice)) {
+		t.Errorf("client got %q before the connection closed", rest)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+	if left := len(sessions.all()); left != 0 {
+		t.Errorf("%d sessions left after shutdown", left)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("listener still accepts clients")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// handshakeTimeout is how long a TLS client gets to finish its handshake
+const handshakeTimeout = 10 * time.Second
+
+var genCert = flag.String("gen-cert", "", "write a self-signed certificate for these comma separated hosts to -tls-cert and -tls-key, then exit")
+
+// tlsSettings is the TLS listener. With a client CA, clients can log in
+// with a certificate signed by it and go by its common name.
+type tlsSettings struct {
+	Listen            string `json:"listen"`
+	Cert              string `json:"cert"`
+	Key               string `json:"key"`
+	ClientCA          string `json:"client_ca"`
+	RequireClientCert bool   `json:"require_client_cert"`
+}
+
+func (t tlsSettings) check() error {
+	if t.Listen == "" {
+		return nil
+	}
+	if t.RequireClientCert && t.ClientCA == "" {
+		return errors.New("require_client_cert needs a client_ca")
+	}
+	for _, path := range []string{t.Cert, t.Key, t.ClientCA} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverConfig loads the certificate and the client CA
+func (t tlsSettings) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.ClientCA == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(t.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s has no PEM certificates", t.ClientCA)
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if t.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// handshake finishes the TLS handshake of a client of the TLS listener, so
+// its certificate is known before it's asked for a name. There's nothing
+// to do for plain connections.
+func handshake(c *client) error {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return conn.Handshake()
+}
+
+// certName returns the common name of the verified certificate c logged in
+// with, "" if it didn't give one
+func certName(c *client) string {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// certLogin names c after its certificate, resuming the session it left
+// behind under that name if there is one. If the name can't be used c is
+// asked for one as usual. It reports whether a session was resumed.
+func certLogin(c *client) bool {
+	name := certName(c)
+	if name == "" {
+		return false
+	}
+	if err := validateName(name); err != nil {
+		c.send(Red + "The name on your certificate can't be used: " + err.Error() + "\n" + Reset)
+		return false
+	}
+	if old := sessions.lookupName(name); old != nil && old.Name() == name && takeOver(c, old) == nil {
+		return true
+	}
+	registered, ok := users.registered(name)
+	if ok && registered != name {
+		c.send(Red + "The name on your certificate looks too much like " + registered + "'s\n" + Reset)
+		return false
+	}
+	if err := sessions.rename(c, name); err != nil {
+		c.send(Red + err.Error() + "\n" + Reset)
+		return false
+	}
+	if ok {
+		c.loginSucceeded(registered)
+	}
+	infof("%s logged in with a certificate", name)
+	c.send(Green + "You're " + name + ", going by your certificate\n" + Reset)
+	offerResume(c)
+	return false
+}
+
+// writeSelfSigned writes a new self-signed certificate for hosts and its key
+// to certPath and keyPath, for setups that don't have a real one
+func writeSelfSigned(hosts []string, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"TCPChat"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// makeCert handles -gen-cert, writing the certificate where the config
+// expects it
+func makeCert(hosts string) {
+	cfg, err := readSettings()
+	errorCheck("Error loading the config:", err)
+	var list []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			list = append(list, host)
+		}
+	}
+	if len(list) == 0 {
+		errorCheck("Error making the certificate:", errors.New("-gen-cert needs at least one host"))
+	}
+	errorCheck("Error making the certificate:", writeSelfSigned(list, cfg.TLS.Cert, cfg.TLS.Key))
+	fmt.Printf("Wrote a certificate for %s to %s and its key to %s\n", strings.Join(list, ", "), cfg.TLS.Cert, cfg.TLS.Key)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	settings := tlsSettings{
+		Listen: ":0",
+		Cert:   filepath.Join(dir, "cert.pem"),
+		Key:    filepath.Join(dir, "key.pem"),
+	}
+	if err := writeSelfSigned([]string{"chat.local", "127.0.0.1"}, settings.Cert, settings.Key); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := settings.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("chat.local"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	settings.ClientCA = settings.Cert
+	if cfg, err = settings.serverConfig(); err != nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("client CA: %v", err)
+	}
+	settings.RequireClientCert = true
+	if cfg, err = settings.serverConfig(); err != nil || cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("required client certificates: %v", err)
+	}
+	settings.ClientCA = ""
+	if settings.check() == nil {
+		t.Error("required client certificates without a CA")
+	}
+	settings.Cert = filepath.Join(dir, "missing.pem")
+	if settings.check() == nil {
+		t.Error("missing certificate wasn't reported")
+	}
+}
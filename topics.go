@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const topicsFile = "topics.json"
+
+// topicStore keeps the last topic set with :topic: in each room, apart from
+// the history so retention never drops it and a room starting up doesn't
+// have to read through its history to find it
+type topicStore struct {
+	path   string
+	mu     sync.Mutex
+	topics map[string]string
+}
+
+var topics = &topicStore{topics: make(map[string]string)}
+
+func newTopicStore(path string) (*topicStore, error) {
+	s := &topicStore{path: path, topics: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.topics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the topic last set in room, if one was
+func (s *topicStore) get(room string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topic, ok := s.topics[room]
+	return topic, ok
+}
+
+func (s *topicStore) set(room, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.topics[room]
+	s.topics[room] = topic
+	if err := s.save(); err != nil {
+		if had {
+			s.topics[room] = old
+		} else {
+			delete(s.topics, room)
+		}
+		return err
+	}
+	return nil
+}
+
+// wipe forgets every topic
+func (s *topicStore) wipe() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topics = make(map[string]string)
+	return s.save()
+}
+
+// save writes the topics to a temporary file first and moves it over the
+// old one, so a crash never leaves half a topics file
+func (s *topicStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.topics, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// openTopics loads the topics from the data dir, forgetting them along with
+// the history when the server was started with -wipe
+func openTopics() {
+	store, err := newTopicStore(filepath.Join(config().DataDir, topicsFile))
+	errorCheck("Error opening the topics:", err)
+	if *wipeOnBoot {
+		errorCheck("Error clearing the topics:", store.wipe())
+	}
+	topics = store
+}
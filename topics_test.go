@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTopicStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), topicsFile)
+	s, err := newTopicStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("standup", "yesterday/today"); err != nil {
+		t.Fatal(err)
+	}
+	s, err = newTopicStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic, ok := s.get("standup"); !ok || topic != "yesterday/today" {
+		t.Errorf("topic after reopening = %q, %v", topic, ok)
+	}
+
+	// a room starting up goes by the last topic set in it
+	defer func(old *topicStore) { topics = old }(topics)
+	topics = s
+	r := getRoom("standup")
+	if _, settings := r.info(); settings.Topic != "yesterday/today" {
+		t.Errorf("room started with topic %q", settings.Topic)
+	}
+
+	if err := s.wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.get("standup"); ok {
+		t.Error("wipe kept the topic")
+	}
+}